@@ -0,0 +1,219 @@
+package imdl
+
+import (
+	"math"
+	"sort"
+)
+
+type AuxVectorInput struct {
+	Input  float32
+	Values [][3]float32
+}
+
+type AuxScalarInput struct {
+	Input  float32
+	Values []float32
+}
+
+type AuxChannels struct {
+	Displacements map[string][]AuxVectorInput
+	Normals       map[string][]AuxVectorInput
+	Params        map[string][]AuxScalarInput
+}
+
+func NewAuxChannels() *AuxChannels {
+	return &AuxChannels{
+		Displacements: make(map[string][]AuxVectorInput),
+		Normals:       make(map[string][]AuxVectorInput),
+		Params:        make(map[string][]AuxScalarInput),
+	}
+}
+
+func sortedAuxVectorNames(m map[string][]AuxVectorInput) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedAuxScalarNames(m map[string][]AuxScalarInput) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t *AuxChannelTable) decodeu16(vertex int, index uint32) uint16 {
+	byteIndex := vertex*int(t.NumBytesPerVertex) + int(index)*2
+	if byteIndex+1 >= len(t.AuxChannelData) {
+		return 0
+	}
+	return uint16(t.AuxChannelData[byteIndex]) | uint16(t.AuxChannelData[byteIndex+1])<<8
+}
+
+func (t *AuxChannelTable) encodeu16(vertex int, index uint32, val uint16) {
+	byteIndex := vertex*int(t.NumBytesPerVertex) + int(index)*2
+	t.AuxChannelData[byteIndex] = byte(val & 0x00ff)
+	t.AuxChannelData[byteIndex+1] = byte(val >> 8)
+}
+
+func (t *AuxChannelTable) Decode(data []byte) {
+	t.AuxChannelData = data
+	t.Channels = NewAuxChannels()
+
+	count := int(t.Count)
+
+	for _, c := range t.Displacements {
+		if len(c.QOrigin) < 3 || len(c.QScale) < 3 {
+			continue
+		}
+		inputs := make([]AuxVectorInput, 0, len(c.Inputs))
+		for k := 0; k < len(c.Inputs) && k < len(c.Indices); k++ {
+			values := make([][3]float32, count)
+			for v := range values {
+				for j := 0; j < 3; j++ {
+					values[v][j] = UnQuantize(t.decodeu16(v, c.Indices[k]+uint32(j)), c.QOrigin[j], c.QScale[j])
+				}
+			}
+			inputs = append(inputs, AuxVectorInput{Input: c.Inputs[k], Values: values})
+		}
+		t.Channels.Displacements[c.Name] = inputs
+	}
+
+	for _, c := range t.Normals {
+		inputs := make([]AuxVectorInput, 0, len(c.Inputs))
+		for k := 0; k < len(c.Inputs) && k < len(c.Indices); k++ {
+			values := make([][3]float32, count)
+			for v := range values {
+				values[v] = decodeValue(t.decodeu16(v, c.Indices[k]))
+			}
+			inputs = append(inputs, AuxVectorInput{Input: c.Inputs[k], Values: values})
+		}
+		t.Channels.Normals[c.Name] = inputs
+	}
+
+	for _, c := range t.Params {
+		if len(c.QOrigin) < 1 || len(c.QScale) < 1 {
+			continue
+		}
+		inputs := make([]AuxScalarInput, 0, len(c.Inputs))
+		for k := 0; k < len(c.Inputs) && k < len(c.Indices); k++ {
+			values := make([]float32, count)
+			for v := range values {
+				values[v] = UnQuantize(t.decodeu16(v, c.Indices[k]), c.QOrigin[0], c.QScale[0])
+			}
+			inputs = append(inputs, AuxScalarInput{Input: c.Inputs[k], Values: values})
+		}
+		t.Channels.Params[c.Name] = inputs
+	}
+}
+
+func (t *AuxChannelTable) Encode(channels *AuxChannels, vertexCount uint32) {
+	t.Channels = channels
+	t.Count = vertexCount
+	t.Displacements = nil
+	t.Normals = nil
+	t.Params = nil
+
+	displacementNames := sortedAuxVectorNames(channels.Displacements)
+	normalNames := sortedAuxVectorNames(channels.Normals)
+	paramNames := sortedAuxScalarNames(channels.Params)
+
+	numBytesPerVertex := uint32(0)
+	for _, name := range displacementNames {
+		numBytesPerVertex += uint32(len(channels.Displacements[name])) * 6
+	}
+	for _, name := range normalNames {
+		numBytesPerVertex += uint32(len(channels.Normals[name])) * 2
+	}
+	for _, name := range paramNames {
+		numBytesPerVertex += uint32(len(channels.Params[name])) * 2
+	}
+	t.NumBytesPerVertex = numBytesPerVertex
+
+	var dims *Dimensions
+	if numBytesPerVertex%4 != 0 {
+		dims = ComputeDimensions((vertexCount+1)/2, numBytesPerVertex/2, 0)
+	} else {
+		dims = ComputeDimensions(vertexCount, numBytesPerVertex/4, 0)
+	}
+	t.Width = dims.Width
+	t.Height = dims.Height
+	t.AuxChannelData = make([]byte, dims.Width*dims.Height*4)
+
+	index := uint32(0)
+
+	for _, name := range displacementNames {
+		inputs := channels.Displacements[name]
+		r := &Range3d{Low: [3]float32{math.MaxFloat32, math.MaxFloat32, math.MaxFloat32}, High: [3]float32{-math.MaxFloat32, -math.MaxFloat32, -math.MaxFloat32}}
+		for _, in := range inputs {
+			for _, val := range in.Values {
+				r.Extend(val)
+			}
+		}
+		qparams := &QParams3d{}
+		qparams.SetFromRange(r, rangeScale16)
+
+		c := QuantizedAuxChannel{AuxChannel: AuxChannel{Name: name}, QOrigin: qparams.Origin[:], QScale: qparams.Scale[:]}
+		for _, in := range inputs {
+			c.Inputs = append(c.Inputs, in.Input)
+			c.Indices = append(c.Indices, index)
+			for v := 0; v < int(vertexCount) && v < len(in.Values); v++ {
+				q := QuantizePoint3d(in.Values[v], qparams)
+				for j := 0; j < 3; j++ {
+					t.encodeu16(v, index+uint32(j), q[j])
+				}
+			}
+			index += 3
+		}
+		t.Displacements = append(t.Displacements, c)
+	}
+
+	for _, name := range normalNames {
+		inputs := channels.Normals[name]
+		c := AuxChannel{Name: name}
+		for _, in := range inputs {
+			c.Inputs = append(c.Inputs, in.Input)
+			c.Indices = append(c.Indices, index)
+			for v := 0; v < int(vertexCount) && v < len(in.Values); v++ {
+				t.encodeu16(v, index, encodeXYZ(in.Values[v][0], in.Values[v][1], in.Values[v][2]))
+			}
+			index++
+		}
+		t.Normals = append(t.Normals, c)
+	}
+
+	for _, name := range paramNames {
+		inputs := channels.Params[name]
+		low, high := float32(math.MaxFloat32), float32(-math.MaxFloat32)
+		for _, in := range inputs {
+			for _, val := range in.Values {
+				if val < low {
+					low = val
+				}
+				if val > high {
+					high = val
+				}
+			}
+		}
+		if low > high {
+			low, high = 0, 0
+		}
+		scale := computeScale(high-low, rangeScale16)
+
+		c := QuantizedAuxChannel{AuxChannel: AuxChannel{Name: name}, QOrigin: []float32{low}, QScale: []float32{scale}}
+		for _, in := range inputs {
+			c.Inputs = append(c.Inputs, in.Input)
+			c.Indices = append(c.Indices, index)
+			for v := 0; v < int(vertexCount) && v < len(in.Values); v++ {
+				t.encodeu16(v, index, Quantize(in.Values[v], low, scale, rangeScale16))
+			}
+			index++
+		}
+		t.Params = append(t.Params, c)
+	}
+}
@@ -0,0 +1,249 @@
+package imdl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+
+	"github.com/flywave/gltf"
+)
+
+const (
+	b3dmMagic   = "b3dm"
+	b3dmVersion = 1
+
+	// BatchIdAttribute is the vertex attribute that holds batch ids in b3dm
+	// tiles.
+	BatchIdAttribute = "_BATCHID"
+)
+
+type b3dmHeader struct {
+	Magic                        [4]byte
+	Version                      uint32
+	ByteLength                   uint32
+	FeatureTableJSONByteLength   uint32
+	FeatureTableBinaryByteLength uint32
+	BatchTableJSONByteLength     uint32
+	BatchTableBinaryByteLength   uint32
+}
+
+type b3dmFeatureTable struct {
+	BatchLength uint32     `json:"BATCH_LENGTH"`
+	RtcCenter   [3]float64 `json:"RTC_CENTER"`
+}
+
+// B3dmBatchTable holds the properties of every batch, a batch being a
+// feature index of the document.
+type B3dmBatchTable struct {
+	CategoryId    []string `json:"CategoryId"`
+	SubCategoryId []string `json:"SubCategoryId"`
+	MaterialId    []string `json:"MaterialId"`
+}
+
+func primitiveVertexs(item PrimitiveItem) (*VertexTable, []*SimpleVertex) {
+	switch p := item.(type) {
+	case *MeshPrimitive:
+		if p.Data != nil {
+			return &p.Vertices, p.Data.simpleVertexs()
+		}
+	case *PolylinePrimitive:
+		if p.Data != nil {
+			return &p.Vertices, p.Data.simpleVertexs()
+		}
+	case *PointStringPrimitive:
+		if p.Data != nil {
+			return &p.Vertices, p.Data.simpleVertexs()
+		}
+	}
+	return nil, nil
+}
+
+// flattenedDocument returns a copy of a document that shares everything but
+// the meshes, whose instances are expanded.
+func flattenedDocument(doc *Document) *Document {
+	out := *doc
+	out.Meshes = make(map[string]*Mesh, len(doc.Meshes))
+	for k, mesh := range doc.Meshes {
+		m := *mesh
+		m.Primitives = make([]PrimitiveItem, len(mesh.Primitives))
+		for i, item := range mesh.Primitives {
+			m.Primitives[i] = flattenedCopy(item)
+		}
+		out.Meshes[k] = &m
+	}
+	return &out
+}
+
+type b3dmBatches struct {
+	table B3dmBatchTable
+	// noFeature is the batch of the vertices without a feature, if any.
+	noFeature *uint32
+	assigned  []bool
+	low       vec3
+	high      vec3
+}
+
+func (b *b3dmBatches) set(id uint32, mat *Material) {
+	for uint32(len(b.assigned)) <= id {
+		b.table.CategoryId = append(b.table.CategoryId, "")
+		b.table.SubCategoryId = append(b.table.SubCategoryId, "")
+		b.table.MaterialId = append(b.table.MaterialId, "")
+		b.assigned = append(b.assigned, false)
+	}
+	if b.assigned[id] {
+		return
+	}
+	b.assigned[id] = true
+	if mat != nil {
+		b.table.CategoryId[id] = mat.CategoryId
+		b.table.SubCategoryId[id] = mat.SubCategoryId
+		b.table.MaterialId[id] = mat.MaterialId
+	}
+}
+
+func (b *b3dmBatches) extend(p [3]float32) {
+	for i := range p {
+		b.low[i] = math.Min(b.low[i], float64(p[i]))
+		b.high[i] = math.Max(b.high[i], float64(p[i]))
+	}
+}
+
+// collectBatches assigns the batch table properties of every feature from
+// the material of the first primitive it appears in, and finds the range of
+// the document.
+func collectBatches(doc *Document) *b3dmBatches {
+	b := &b3dmBatches{low: vec3{math.Inf(1), math.Inf(1), math.Inf(1)}, high: vec3{math.Inf(-1), math.Inf(-1), math.Inf(-1)}}
+	var unfeatured *Material
+	hasUnfeatured := false
+	for _, k := range sortedKeys(doc.Meshes) {
+		for _, item := range doc.Meshes[k].Primitives {
+			table, vertexs := primitiveVertexs(item)
+			if table == nil {
+				continue
+			}
+			prim := item.GetPrimitive()
+			mat := doc.Materials[prim.Material]
+			if prim.ViewIndependentOrigin != nil {
+				b.extend(*prim.ViewIndependentOrigin)
+			}
+			for _, v := range vertexs {
+				b.extend(v.Pos)
+				if id, ok := table.vertexFeatureId(v); ok {
+					b.set(id, mat)
+				} else if !hasUnfeatured {
+					hasUnfeatured, unfeatured = true, mat
+				}
+			}
+		}
+	}
+	if hasUnfeatured {
+		id := uint32(len(b.assigned))
+		b.noFeature = &id
+		b.set(id, unfeatured)
+	}
+	return b
+}
+
+// rtcCenter is the center of the document range, which encloses the
+// expanded instances and the view independent origins.
+func (b *b3dmBatches) rtcCenter() [3]float64 {
+	if b.low[0] > b.high[0] {
+		return [3]float64{}
+	}
+	c := b.low.add(b.high).scale(0.5)
+	return [3]float64{c[0], c[1], c[2]}
+}
+
+// b3dmJSON marshals a b3dm table padded with spaces so that the data after
+// it starts on an 8 byte boundary.
+func b3dmJSON(v interface{}, offset int) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	padding := calcPadding(uint32(offset+len(data)), 8)
+	return append(data, bytes.Repeat([]byte{' '}, int(padding))...), nil
+}
+
+// ExportB3dm writes a document as a Cesium 3D Tiles b3dm tile. Instances are
+// expanded, feature indices become _BATCHID values and the batch table holds
+// the category, subcategory and render material of every feature. Vertices
+// without a feature share a batch of their own. The RTC center is the center
+// of the document range, including instance transform centers and view
+// independent origins; view independent primitives are written in their
+// modeled orientation.
+func ExportB3dm(doc *Document, w io.Writer) error {
+	flat := flattenedDocument(doc)
+	batches := collectBatches(flat)
+	center := batches.rtcCenter()
+
+	e := newGltfExporter(flat)
+	e.featureAttribute = BatchIdAttribute
+	e.noFeature = batches.noFeature
+	out, err := e.export()
+	if err != nil {
+		return err
+	}
+	// The root node moves the RTC center to the origin before turning z up
+	// into y up.
+	root := &out.Nodes[0].Matrix
+	root[12] = float32(-center[0])
+	root[13] = float32(-center[2])
+	root[14] = float32(center[1])
+
+	glb := &bytes.Buffer{}
+	enc := gltf.NewEncoder(glb)
+	enc.AsBinary = true
+	if err := enc.Encode(out); err != nil {
+		return err
+	}
+
+	headerSize := binary.Size(b3dmHeader{})
+	featureTable, err := b3dmJSON(&b3dmFeatureTable{BatchLength: uint32(len(batches.assigned)), RtcCenter: center}, headerSize)
+	if err != nil {
+		return err
+	}
+	batchTable, err := b3dmJSON(&batches.table, headerSize+len(featureTable))
+	if err != nil {
+		return err
+	}
+
+	header := b3dmHeader{
+		Version:                    b3dmVersion,
+		ByteLength:                 uint32(headerSize + len(featureTable) + len(batchTable) + glb.Len()),
+		FeatureTableJSONByteLength: uint32(len(featureTable)),
+		BatchTableJSONByteLength:   uint32(len(batchTable)),
+	}
+	copy(header.Magic[:], b3dmMagic)
+
+	bw := bufio.NewWriter(w)
+	if err := binary.Write(bw, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if _, err := bw.Write(featureTable); err != nil {
+		return err
+	}
+	if _, err := bw.Write(batchTable); err != nil {
+		return err
+	}
+	if _, err := glb.WriteTo(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func SaveB3dm(doc *Document, name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := ExportB3dm(doc, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,122 @@
+package imdl
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+)
+
+type ColorTable struct {
+	Uniform *color.NRGBA
+	Colors  []color.NRGBA
+}
+
+func (t *ColorTable) IsUniform() bool {
+	return t.Uniform != nil
+}
+
+func (t *ColorTable) GetColor(colorIndex uint16) color.NRGBA {
+	if t.Uniform != nil {
+		return *t.Uniform
+	}
+	if int(colorIndex) < len(t.Colors) {
+		return t.Colors[colorIndex]
+	}
+	return color.NRGBA{}
+}
+
+func (t *ColorTable) HasTranslucency() bool {
+	if t.Uniform != nil {
+		return t.Uniform.A != 255
+	}
+	for i := range t.Colors {
+		if t.Colors[i].A != 255 {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxColorTableSize is the largest number of distinct colors a vertex table
+// can index.
+const MaxColorTableSize = 0xffff
+
+// NewColorTable builds a palette from per-vertex colors and returns the
+// color index of each vertex. A single distinct color gives a uniform table.
+func NewColorTable(colors []color.NRGBA) (*ColorTable, []uint16, error) {
+	indices := make([]uint16, len(colors))
+	if len(colors) == 0 {
+		return nil, indices, nil
+	}
+
+	palette := make(map[color.NRGBA]uint16)
+	var table []color.NRGBA
+	for i, c := range colors {
+		index, ok := palette[c]
+		if !ok {
+			if len(table) == MaxColorTableSize {
+				return nil, nil, fmt.Errorf("imdl: more than %d distinct vertex colors", MaxColorTableSize)
+			}
+			index = uint16(len(table))
+			palette[c] = index
+			table = append(table, c)
+		}
+		indices[i] = index
+	}
+
+	if len(table) == 1 {
+		return &ColorTable{Uniform: &table[0]}, indices, nil
+	}
+	return &ColorTable{Colors: table}, indices, nil
+}
+
+func ColorFromTbgr(tbgr uint32) color.NRGBA {
+	return color.NRGBA{
+		R: uint8(tbgr & 0xff),
+		G: uint8((tbgr >> 8) & 0xff),
+		B: uint8((tbgr >> 16) & 0xff),
+		A: 255 - uint8(tbgr>>24),
+	}
+}
+
+func ColorToTbgr(c color.NRGBA) uint32 {
+	return uint32(c.R) | uint32(c.G)<<8 | uint32(c.B)<<16 | uint32(255-c.A)<<24
+}
+
+func unpremultiplyColor(c color.RGBA) color.NRGBA {
+	switch c.A {
+	case 0:
+		return color.NRGBA{}
+	case 255:
+		return color.NRGBA{R: c.R, G: c.G, B: c.B, A: c.A}
+	}
+	f := 255.0 / float64(c.A)
+	unpremultiply := func(v uint8) uint8 {
+		return uint8(math.Min(255, math.Floor(float64(v)*f+0.5)))
+	}
+	return color.NRGBA{R: unpremultiply(c.R), G: unpremultiply(c.G), B: unpremultiply(c.B), A: c.A}
+}
+
+func DecodeColorTable(data []byte, numColors uint32) []color.NRGBA {
+	if len(data) < int(numColors)*4 {
+		return nil
+	}
+	decoder := &VertexDecoder{data: data}
+	colors := make([]color.NRGBA, numColors)
+	index := 0
+	for i := range colors {
+		var c color.RGBA
+		index, c = decoder.DecodeColor(index)
+		colors[i] = unpremultiplyColor(c)
+	}
+	return colors
+}
+
+func EncodeColorTable(colors []color.NRGBA) []byte {
+	builder := &VertexBuilder{data: make([]byte, len(colors)*4)}
+	for _, c := range colors {
+		c.A = 255 - c.A
+		builder.AppendColor(c)
+	}
+	return builder.data
+}
@@ -1,7 +1,8 @@
 package imdl
 
 const (
-	glbHeaderMagic = 0x46546c67
+	glbHeaderMagic  = 0x46546c67
+	imdlHeaderMagic = 0x6c644d69
 )
 
 type JSONHeader struct {
@@ -15,3 +16,22 @@ type glbHeader struct {
 	Length     uint32
 	JSONHeader JSONHeader
 }
+
+type imdlHeader struct {
+	Magic               uint32
+	Version             uint32
+	HeaderLength        uint32
+	Flags               uint32
+	ContentRange        [2][3]float64
+	Tolerance           float64
+	NumElementsIncluded uint32
+	NumElementsExcluded uint32
+	TileLength          uint32
+	// EmptySubRanges follows the header from major version 2 on.
+}
+
+type featureTableHeader struct {
+	Length      uint32
+	MaxFeatures uint32
+	Count       uint32
+}
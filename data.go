@@ -1,6 +1,9 @@
 package imdl
 
-import "math"
+import (
+	"image/color"
+	"math"
+)
 
 type MeshVertex struct {
 	SimpleVertex
@@ -8,12 +11,14 @@ type MeshVertex struct {
 	QUV              *[2]uint16
 	Normal           *[3]float32
 	OctEncodedNormal *uint16
+	MaterialIndex    *uint8
 }
 
 type MeshData struct {
-	Type    SurfaceType
-	Indices []uint32
-	Vertexs []MeshVertex
+	Type      SurfaceType
+	Indices   []uint32
+	Vertexs   []MeshVertex
+	Materials []AtlasMaterial
 }
 
 func (d *MeshData) GetPosRange() *Range3d {
@@ -92,6 +97,14 @@ func (d *MeshData) UnQuantize(qParams3d *QParams3d, qParams2d *QParams2d) {
 	}
 }
 
+func (d *MeshData) simpleVertexs() []*SimpleVertex {
+	vertexs := make([]*SimpleVertex, len(d.Vertexs))
+	for i := range d.Vertexs {
+		vertexs[i] = &d.Vertexs[i].SimpleVertex
+	}
+	return vertexs
+}
+
 func (d *MeshData) EncodeIndices() []byte {
 	return EncodeVertexIndices(d.Indices)
 }
@@ -115,16 +128,43 @@ func (d *MeshData) DecodeVertexs(data []byte, count uint32) {
 	}
 }
 
+func (d *MeshData) DecodeMaterialAtlas(data []byte, numMaterials uint32) {
+	materials := DecodeMaterialAtlas(data, numMaterials)
+	if materials == nil {
+		return
+	}
+	d.Materials = materials
+	for i := range d.Vertexs {
+		v := &d.Vertexs[i]
+		if v.FeatureIndex == nil {
+			continue
+		}
+		materialIndex := uint8(*v.FeatureIndex >> 24)
+		*v.FeatureIndex &= 0x00ffffff
+		v.MaterialIndex = &materialIndex
+	}
+}
+
+func (d *MeshData) EncodeMaterialAtlas() []byte {
+	return EncodeMaterialAtlas(d.Materials)
+}
+
 type SimpleVertex struct {
 	Pos          [3]float32
 	QPos         [3]uint16
+	Color        *color.NRGBA
 	ColorIndex   *uint16
 	FeatureIndex *uint32
 }
 
 type PolylineData struct {
-	Indices []uint32
-	Vertexs []SimpleVertex
+	// Lines holds raw line strings that have not been tesselated yet.
+	Lines       [][]uint32
+	Indices     []uint32
+	PrevIndices []uint32
+	NextIndices []uint32
+	Params      []PolylineParam
+	Vertexs     []SimpleVertex
 }
 
 func (d *PolylineData) GetRange() *Range3d {
@@ -155,6 +195,14 @@ func (d *PolylineData) UnQuantize(qParams3d *QParams3d) {
 	}
 }
 
+func (d *PolylineData) simpleVertexs() []*SimpleVertex {
+	vertexs := make([]*SimpleVertex, len(d.Vertexs))
+	for i := range d.Vertexs {
+		vertexs[i] = &d.Vertexs[i]
+	}
+	return vertexs
+}
+
 func (d *PolylineData) EncodeIndices() []byte {
 	return EncodeVertexIndices(d.Indices)
 }
@@ -163,6 +211,73 @@ func (d *PolylineData) DecodeIndices(bytes []byte) {
 	d.Indices = DecodeVertexIndices(bytes)
 }
 
+func (d *PolylineData) HasPolylineParams() bool {
+	n := len(d.Indices)
+	return n > 0 && len(d.PrevIndices) == n && len(d.NextIndices) == n && len(d.Params) == n
+}
+
+func (d *PolylineData) DecodePolylineParams(prevIndices []byte, nextIndicesAndParams []byte) {
+	d.PrevIndices = DecodeVertexIndices(prevIndices)
+	d.NextIndices, d.Params = DecodeNextIndicesAndParams(nextIndicesAndParams)
+}
+
+func (d *PolylineData) EncodePrevIndices() []byte {
+	return EncodeVertexIndices(d.PrevIndices)
+}
+
+func (d *PolylineData) EncodeNextIndicesAndParams() []byte {
+	return EncodeNextIndicesAndParams(d.NextIndices, d.Params)
+}
+
+func (d *PolylineData) NeedsTesselation() bool {
+	return len(d.Lines) > 0 || (len(d.Indices) > 1 && !d.HasPolylineParams())
+}
+
+// Tesselate replaces the raw line strings in Lines, or Indices read as a
+// single line string when Lines is empty, with the segment quads drawn by
+// the viewer.
+func (d *PolylineData) Tesselate(wantJoints bool) {
+	lines := d.Lines
+	if len(lines) == 0 {
+		lines = [][]uint32{d.Indices}
+	}
+
+	var tp *TesselatedPolyline
+	if wantJoints {
+		points := make([][3]float32, len(d.Vertexs))
+		for i := range d.Vertexs {
+			points[i] = d.Vertexs[i].Pos
+		}
+		tp = TesselatePolylinesWithJoints(lines, points)
+	} else {
+		tp = TesselatePolylines(lines)
+	}
+
+	d.Lines = nil
+	d.Indices = tp.Indices
+	d.PrevIndices = tp.PrevIndices
+	d.NextIndices = tp.NextIndices
+	d.Params = tp.Params
+}
+
+// LineStrings returns the polylines as line strings of vertex indices, read
+// back from the tesselation when the raw lines are gone.
+func (d *PolylineData) LineStrings() [][]uint32 {
+	switch {
+	case len(d.Lines) > 0:
+		return d.Lines
+	case d.HasPolylineParams():
+		return d.GetTesselation().Lines()
+	case len(d.Indices) > 0:
+		return [][]uint32{d.Indices}
+	}
+	return nil
+}
+
+func (d *PolylineData) GetTesselation() *TesselatedPolyline {
+	return &TesselatedPolyline{Indices: d.Indices, PrevIndices: d.PrevIndices, NextIndices: d.NextIndices, Params: d.Params}
+}
+
 func (d *PolylineData) EncodeVertexs() []byte {
 	builder := newSimplePolylineBuilder(len(d.Vertexs))
 	builder.Process(d.Vertexs)
@@ -215,6 +330,14 @@ func (d *PointStringData) UnQuantize(qParams3d *QParams3d) {
 	}
 }
 
+func (d *PointStringData) simpleVertexs() []*SimpleVertex {
+	vertexs := make([]*SimpleVertex, len(d.Vertexs))
+	for i := range d.Vertexs {
+		vertexs[i] = &d.Vertexs[i]
+	}
+	return vertexs
+}
+
 func (d *PointStringData) EncodeIndices() []byte {
 	return EncodeVertexIndices(d.Indices)
 }
@@ -34,7 +34,10 @@ func Open(name string) (*Document, error) {
 type Decoder struct {
 	MaxExternalBufferCount int
 	MaxMemoryAllocation    uint64
-	r                      *bufio.Reader
+	// Passthrough records the state of every decoded primitive, so that an
+	// Encoder with Passthrough can keep the buffers of those left unmodified.
+	Passthrough bool
+	r           *bufio.Reader
 }
 
 func NewDecoder(r io.Reader) *Decoder {
@@ -90,7 +93,7 @@ func (d *Decoder) decodeDocument(doc *Document) (bool, error) {
 	if data, err := d.decodeBinaryBuffer(glbHeader); err != nil {
 		return isBinary, err
 	} else {
-		doc.decodeChunkData(data)
+		doc.decodeChunkData(data, d.Passthrough)
 	}
 
 	return isBinary, err
@@ -1,10 +1,19 @@
 package imdl
 
 import (
+	"bytes"
+	"encoding/hex"
 	"encoding/json"
+	"image/color"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/flywave/gltf"
 )
 
 func TestUnmarshal(t *testing.T) {
@@ -38,3 +47,354 @@ func TestDecode(t *testing.T) {
 	data = doc.FindBuffer("bvVertex4")
 
 }
+
+func TestDecodeColorTable(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	privs := doc.Meshes["Mesh_Root"].Primitives
+
+	uniform := privs[0].GetPrimitive().Vertices.ColorTable
+	if uniform == nil || !uniform.IsUniform() || *uniform.Uniform != (color.NRGBA{R: 0xe1, G: 0xe1, B: 0xe1, A: 0xff}) {
+		t.FailNow()
+	}
+
+	table := privs[1].GetPrimitive().Vertices.ColorTable
+	if table == nil || table.IsUniform() || len(table.Colors) != 8 {
+		t.FailNow()
+	}
+
+	if table.GetColor(0) != (color.NRGBA{R: 0xb4, G: 0xb4, B: 0xb4, A: 0xff}) {
+		t.FailNow()
+	}
+
+	// Vertices without colors have no table and keep no numColors.
+	points := &PointStringPrimitive{Type: PT_Point, Data: &PointStringData{Indices: []uint32{0, 1}, Vertexs: make([]SimpleVertex, 2)}}
+	ndoc := NewDocument()
+	ndoc.Meshes = map[string]*Mesh{MESH_ROOT: {Primitives: []PrimitiveItem{points}}}
+	for i := 0; i < 2; i++ {
+		buf := &bytes.Buffer{}
+		if err := NewEncoder(buf).Encode(ndoc); err != nil {
+			t.FailNow()
+		}
+		ndoc = &Document{}
+		if err := NewDecoder(buf).Decode(ndoc); err != nil {
+			t.FailNow()
+		}
+		v := ndoc.Meshes[MESH_ROOT].Primitives[0].GetPrimitive().Vertices
+		if v.NumColors != nil || v.ColorTable != nil {
+			t.FailNow()
+		}
+	}
+}
+
+func TestColorTableRoundTrip(t *testing.T) {
+	colors := []color.NRGBA{{R: 255, G: 0, B: 0, A: 255}, {R: 0, G: 0, B: 255, A: 128}, {R: 10, G: 20, B: 30, A: 0}}
+
+	builder := &VertexBuilder{data: make([]byte, len(colors)*4)}
+	for _, c := range colors {
+		c.A = 255 - c.A
+		builder.AppendColor(c)
+	}
+
+	decoded := DecodeColorTable(builder.data, uint32(len(colors)))
+	if len(decoded) != len(colors) {
+		t.FailNow()
+	}
+
+	if decoded[0] != colors[0] || decoded[1] != colors[1] || decoded[2].A != 0 {
+		t.FailNow()
+	}
+}
+
+func TestDecodeInstances(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-1-0-1-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	var inst *Instances
+	for _, item := range doc.Meshes["Mesh_Root"].Primitives {
+		if p := item.GetPrimitive(); p != nil && p.Instances != nil && p.Instances.SymbologyOverrides != "" {
+			inst = p.Instances
+			break
+		}
+	}
+
+	if inst == nil || inst.Data == nil || inst.Data.Count() != int(inst.Count) {
+		t.FailNow()
+	}
+
+	if len(inst.Data.FeatureIds) != 4 || inst.Data.FeatureIds[0] != 0x69 || inst.Data.FeatureIds[3] != 0x6c {
+		t.FailNow()
+	}
+
+	if len(inst.Data.SymbologyOverrides) != 4 || !inst.Data.SymbologyOverrides[0].HasFlag(IO_Rgb) || inst.Data.SymbologyOverrides[0].Weight != 1 {
+		t.FailNow()
+	}
+}
+
+func TestDecodeMaterialAtlas(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	prim := doc.Meshes["Mesh_Root"].Primitives[1].(*MeshPrimitive)
+	if prim.Vertices.MaterialAtlas == nil || len(prim.Data.Materials) != 5 {
+		t.FailNow()
+	}
+
+	m := prim.Data.Materials[0]
+	if m.DiffuseColor == nil || m.DiffuseColor[0] != 1 || m.Transparency == nil || *m.Transparency != 0 || m.Diffuse < 0.5 || m.Diffuse > 0.51 {
+		t.FailNow()
+	}
+
+	for _, v := range prim.Data.Vertexs {
+		if v.MaterialIndex == nil || *v.MaterialIndex >= 5 || *v.FeatureIndex > 0x00ffffff {
+			t.FailNow()
+		}
+	}
+
+	// Feature indices are left alone when the atlas can't be read.
+	fid := uint32(0x03000005)
+	data := &MeshData{Vertexs: []MeshVertex{{SimpleVertex: SimpleVertex{FeatureIndex: &fid}}}}
+	data.DecodeMaterialAtlas(make([]byte, 16), 2)
+	if data.Materials != nil || data.Vertexs[0].MaterialIndex != nil || fid != 0x03000005 {
+		t.FailNow()
+	}
+}
+
+func TestImportGltf(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	src, err := ExportGltf(doc)
+	if err != nil {
+		t.FailNow()
+	}
+	src.Animations = []*gltf.Animation{{}}
+
+	idoc, unsupported, err := ImportGltf(src)
+	if err != nil || len(unsupported) != 1 || unsupported[0] != "animations" {
+		t.FailNow()
+	}
+
+	prims := idoc.Meshes[MESH_ROOT].Primitives
+	if len(prims) != 25+1+4 || len(idoc.NamedTextures) == 0 {
+		t.FailNow()
+	}
+
+	mesh := doc.Meshes[MESH_ROOT].Primitives[0].(*MeshPrimitive)
+	imesh := prims[0].(*MeshPrimitive)
+	if imesh.Data.Type != mesh.Data.Type || imesh.Vertices.FeatureIndexType != Uniform || *imesh.Vertices.FeatureId != *mesh.Vertices.FeatureId {
+		t.FailNow()
+	}
+	for i := range mesh.Data.Vertexs {
+		a, b := mesh.Data.Vertexs[i].Pos, imesh.Data.Vertexs[i].Pos
+		if toVec3(a).sub(toVec3(b)).length() > 1e-5 {
+			t.FailNow()
+		}
+	}
+	if len(imesh.Data.Indices) != len(mesh.Data.Indices) {
+		t.FailNow()
+	}
+
+	// The base color comes back as the render material diffuse color.
+	out, err := ExportGltf(idoc)
+	if err != nil {
+		t.FailNow()
+	}
+	baseColor := func(doc *gltf.Document) [4]float32 {
+		root := doc.Meshes[*doc.Nodes[1].Mesh]
+		return *doc.Materials[*root.Primitives[0].Material].PBRMetallicRoughness.BaseColorFactor
+	}
+	want, got := baseColor(src), baseColor(out)
+	for i := range want {
+		if math.Abs(float64(want[i]-got[i])) > 1e-2 {
+			t.FailNow()
+		}
+	}
+
+	segments := func(lines [][]uint32) [][2]uint32 {
+		var r [][2]uint32
+		for _, l := range lines {
+			for i := 0; i+1 < len(l); i++ {
+				r = append(r, [2]uint32{l[i], l[i+1]})
+			}
+		}
+		return r
+	}
+	line := prims[25].(*PolylinePrimitive)
+	if !reflect.DeepEqual(segments(line.Data.Lines), segments(doc.Meshes[MESH_ROOT].Primitives[25].(*PolylinePrimitive).Data.GetTesselation().Lines())) {
+		t.FailNow()
+	}
+
+	inst := doc.Meshes[MESH_ROOT].Primitives[26].(*MeshPrimitive)
+	for i := 0; i < 4; i++ {
+		p := prims[26+i].(*MeshPrimitive)
+		want := inst.Instances.Data.TransformPoint(i, inst.Instances.GetTransformCenter(), inst.Data.Vertexs[0].Pos)
+		if p.Vertices.FeatureIndexType != Uniform || *p.Vertices.FeatureId != inst.Instances.Data.FeatureIds[i] || toVec3(want).sub(toVec3(p.Data.Vertexs[0].Pos)).length() > 1e-4 {
+			t.FailNow()
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).Encode(idoc); err != nil {
+		t.FailNow()
+	}
+	odoc := &Document{}
+	if err := NewDecoder(buf).Decode(odoc); err != nil || len(odoc.Meshes[MESH_ROOT].Primitives) != len(prims) {
+		t.FailNow()
+	}
+}
+
+func TestTransformNormal(t *testing.T) {
+	m := trsMat4([3]float32{1, 2, 3}, [4]float32{0, 0, 0, 1}, [3]float32{2, 1, 1})
+	n := m.transformNormal(normalizeVector([3]float32{1, 1, 0}))
+	if math.Abs(float64(n[0])-1/math.Sqrt(5)) > 1e-6 || math.Abs(float64(n[1])-2/math.Sqrt(5)) > 1e-6 {
+		t.FailNow()
+	}
+	if p := m.transformPoint([3]float32{1, 1, 1}); p != [3]float32{3, 3, 4} {
+		t.FailNow()
+	}
+	if p := yUpToZUp.transformPoint([3]float32{1, 2, 3}); p != [3]float32{1, -3, 2} {
+		t.FailNow()
+	}
+}
+
+func TestImportObj(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+	dir, err := ioutil.TempDir("", "imdl")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	if err := SaveObj(doc, filepath.Join(dir, "tile.obj")); err != nil {
+		t.FailNow()
+	}
+
+	idoc, err := OpenObj(filepath.Join(dir, "tile.obj"))
+	if err != nil || len(idoc.NamedTextures) == 0 {
+		t.FailNow()
+	}
+	triangles, lines := 0, 0
+	for _, item := range idoc.Meshes[MESH_ROOT].Primitives {
+		switch p := item.(type) {
+		case *MeshPrimitive:
+			triangles += len(p.Data.Indices) / 3
+			if p.Data.Type == ST_TexturedLit && idoc.Materials[p.Material].Texture == nil {
+				t.FailNow()
+			}
+		case *PolylinePrimitive:
+			lines += len(p.Data.Lines)
+		}
+	}
+	if triangles != 33621 || lines != 9 {
+		t.FailNow()
+	}
+
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	enc.AsBinary = true
+	if err := enc.Encode(idoc); err != nil {
+		t.FailNow()
+	}
+	odoc := &Document{}
+	if err := NewDecoder(buf).Decode(odoc); err != nil || len(odoc.Meshes[MESH_ROOT].Primitives) != len(idoc.Meshes[MESH_ROOT].Primitives) {
+		t.FailNow()
+	}
+}
+
+func TestImportObjPolygons(t *testing.T) {
+	src := `
+v 0 0 0
+v 2 0 0
+v 2 2 0
+v 1 2 0
+v 1 1 0
+v 0 1 0
+vn 0 0 1
+g shape
+f 1//1 2//1 3//1 4//1 5//1 6//1
+usemtl red
+f -3 -2 -1
+l 1 2 3
+p 4 5
+`
+	doc, err := ImportObj(strings.NewReader(src))
+	if err != nil {
+		t.FailNow()
+	}
+	prims := doc.Meshes[MESH_ROOT].Primitives
+	if len(prims) != 4 {
+		t.FailNow()
+	}
+	concave := prims[0].(*MeshPrimitive)
+	if concave.Data.Type != ST_Lit || len(concave.Data.Indices) != 12 {
+		t.FailNow()
+	}
+	// The triangles of the concave polygon cover its area, 3, without
+	// overlapping.
+	area := 0.0
+	for i := 0; i < len(concave.Data.Indices); i += 3 {
+		a := toVec3(concave.Data.Vertexs[concave.Data.Indices[i]].Pos)
+		b := toVec3(concave.Data.Vertexs[concave.Data.Indices[i+1]].Pos)
+		c := toVec3(concave.Data.Vertexs[concave.Data.Indices[i+2]].Pos)
+		z := b.sub(a).cross(c.sub(a))[2]
+		if z <= 0 {
+			t.FailNow()
+		}
+		area += z / 2
+	}
+	if math.Abs(area-3) > 1e-6 {
+		t.FailNow()
+	}
+
+	if p := prims[1].(*MeshPrimitive); p.Data.Type != ST_Unlit || len(p.Data.Vertexs) != 3 || p.Data.Vertexs[0].Pos != [3]float32{1, 2, 0} {
+		t.FailNow()
+	}
+	if p := prims[2].(*PolylinePrimitive); !reflect.DeepEqual(p.Data.Lines, [][]uint32{{0, 1, 2}}) {
+		t.FailNow()
+	}
+	if p := prims[3].(*PointStringPrimitive); len(p.Data.Indices) != 2 {
+		t.FailNow()
+	}
+}
+
+func TestDecodeFeatureTable(t *testing.T) {
+	// A PackedFeatureTable keeps the subcategory index in the low 24 bits
+	// and the geometry class in the high 8 bits.
+	data, _ := hex.DecodeString("34000000" + "0a000000" + "02000000" +
+		"1a00000000000000" + "01000003" +
+		"1b00000000000000" + "00000001" +
+		"1800000000000000" + "1900000000020000")
+	table, err := DecodeFeatureTable(data)
+	if err != nil {
+		t.FailNow()
+	}
+	want := []Feature{
+		{ElementId: 0x1a, SubCategoryId: 0x20000000019, GeometryClass: GC_Pattern},
+		{ElementId: 0x1b, SubCategoryId: 0x18, GeometryClass: GC_Construction},
+	}
+	if table.MaxFeatures != 10 || !reflect.DeepEqual(table.Features, want) {
+		t.FailNow()
+	}
+
+	// Subcategories are written in order of first use.
+	table.Features[0], table.Features[1] = table.Features[1], table.Features[0]
+	encoded := EncodeFeatureTable(table)
+	if hex.EncodeToString(encoded) != "34000000"+"0a000000"+"02000000"+
+		"1b00000000000000"+"00000001"+
+		"1a00000000000000"+"01000003"+
+		"1800000000000000"+"1900000000020000" {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,87 @@
+package imdl
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"sort"
+)
+
+type digestWriter struct {
+	w   *bufio.Writer
+	buf [8]byte
+}
+
+func (d *digestWriter) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(d.buf[:], v)
+	d.w.Write(d.buf[:])
+}
+
+func (d *digestWriter) value(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			d.w.WriteByte(1)
+		} else {
+			d.w.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		d.uint64(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		d.uint64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		d.uint64(math.Float64bits(v.Float()))
+	case reflect.String:
+		d.uint64(uint64(v.Len()))
+		d.w.WriteString(v.String())
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			d.w.WriteByte(0)
+			return
+		}
+		d.w.WriteByte(1)
+		d.value(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			d.w.WriteByte(0)
+			return
+		}
+		d.w.WriteByte(1)
+		fallthrough
+	case reflect.Array:
+		d.uint64(uint64(v.Len()))
+		if v.Type().Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			d.w.Write(v.Bytes())
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			d.value(v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			d.value(v.Field(i))
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		d.uint64(uint64(len(keys)))
+		for _, k := range keys {
+			d.value(k)
+			d.value(v.MapIndex(k))
+		}
+	}
+}
+
+func digestValues(values ...interface{}) []byte {
+	h := sha256.New()
+	d := &digestWriter{w: bufio.NewWriter(h)}
+	for _, v := range values {
+		d.value(reflect.ValueOf(&v).Elem())
+	}
+	d.w.Flush()
+	return h.Sum(nil)
+}
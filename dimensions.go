@@ -2,7 +2,9 @@ package imdl
 
 import "math"
 
-const maxTextureSize = 1024
+// maxTextureSize is the widest single row vertex table, as written by the
+// iTwin tile generator.
+const maxTextureSize = 4096
 
 type Dimensions struct {
 	Width  uint32
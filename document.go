@@ -1,11 +1,15 @@
 package imdl
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"io"
 	"reflect"
+	"sort"
 	"unsafe"
 
 	"github.com/flywave/gltf"
@@ -36,11 +40,12 @@ type MaterialAtlas struct {
 }
 
 type Instances struct {
-	Count              uint32    `json:"count,omitempty"`
-	TransformCenter    []float32 `json:"transformCenter,omitempty"`
-	FeatureIds         string    `json:"featureIds,omitempty"`
-	Transforms         string    `json:"transforms,omitempty"`
-	SymbologyOverrides string    `json:"symbologyOverrides,omitempty"`
+	Count              uint32        `json:"count,omitempty"`
+	TransformCenter    []float32     `json:"transformCenter,omitempty"`
+	FeatureIds         string        `json:"featureIds,omitempty"`
+	Transforms         string        `json:"transforms,omitempty"`
+	SymbologyOverrides string        `json:"symbologyOverrides,omitempty"`
+	Data               *InstanceData `json:"-"`
 }
 
 type VertexTable struct {
@@ -61,6 +66,131 @@ type VertexTable struct {
 	} `json:"params"`
 	MaterialAtlas *MaterialAtlas `json:"materialAtlas,omitempty"`
 	VertexData    []byte         `json:"-"`
+	ColorTable    *ColorTable    `json:"-"`
+}
+
+func (v *VertexTable) colorTableOffset() int {
+	return int(v.Count * v.NumRgbaPerVertex * 4)
+}
+
+func (v *VertexTable) vertexData(data []byte) []byte {
+	if offset := v.colorTableOffset(); offset > 0 && offset <= len(data) {
+		return data[:offset]
+	}
+	return data
+}
+
+func (v *VertexTable) materialAtlasOffset() int {
+	offset := v.colorTableOffset()
+	if v.NumColors != nil {
+		offset += int(*v.NumColors) * 4
+	}
+	return offset
+}
+
+// SetColor gives all vertices of the table the same color. Vertices with a
+// color of their own keep it.
+func (v *VertexTable) SetColor(c color.NRGBA) {
+	v.ColorTable = &ColorTable{Uniform: &c}
+}
+
+func (v *VertexTable) buildColorTable(vertexs []*SimpleVertex) error {
+	hasColors := false
+	for _, sv := range vertexs {
+		if sv.Color != nil {
+			hasColors = true
+			break
+		}
+	}
+	if !hasColors {
+		return nil
+	}
+
+	colors := make([]color.NRGBA, len(vertexs))
+	for i, sv := range vertexs {
+		switch {
+		case sv.Color != nil:
+			colors[i] = *sv.Color
+		case v.ColorTable != nil && sv.ColorIndex != nil:
+			colors[i] = v.ColorTable.GetColor(*sv.ColorIndex)
+		case v.ColorTable != nil && v.ColorTable.IsUniform():
+			colors[i] = *v.ColorTable.Uniform
+		default:
+			colors[i] = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+		}
+	}
+
+	table, indices, err := NewColorTable(colors)
+	if err != nil {
+		return err
+	}
+	v.ColorTable = table
+	for i, sv := range vertexs {
+		index := indices[i]
+		sv.ColorIndex = &index
+	}
+	return nil
+}
+
+func (v *VertexTable) encodeColorTable() []byte {
+	if v.ColorTable == nil {
+		return nil
+	}
+	v.HasTranslucency = v.ColorTable.HasTranslucency()
+	numColors := uint32(0)
+	if v.ColorTable.Uniform != nil {
+		v.NumColors = &numColors
+		v.UniformColor = ColorToTbgr(*v.ColorTable.Uniform)
+		return nil
+	}
+	numColors = uint32(len(v.ColorTable.Colors))
+	v.NumColors = &numColors
+	v.UniformColor = 0
+	return EncodeColorTable(v.ColorTable.Colors)
+}
+
+func (v *VertexTable) DecodeColorTable(data []byte) {
+	if v.NumColors == nil {
+		return
+	}
+	if *v.NumColors == 0 {
+		c := ColorFromTbgr(v.UniformColor)
+		v.ColorTable = &ColorTable{Uniform: &c}
+		return
+	}
+	offset := v.colorTableOffset()
+	if offset > len(data) {
+		return
+	}
+	if colors := DecodeColorTable(data[offset:], *v.NumColors); colors != nil {
+		v.ColorTable = &ColorTable{Colors: colors}
+	}
+}
+
+func (v *VertexTable) updateParams(r *Range3d) {
+	v.Params.DecodedMin = r.Low[:]
+	v.Params.DecodedMax = r.High[:]
+	v.Params.DecodeMatrix = make([]float32, 16)
+	for i := 0; i < 3; i++ {
+		v.Params.DecodeMatrix[i*5] = (r.High[i] - r.Low[i]) / rangeScale16
+		v.Params.DecodeMatrix[12+i] = r.Low[i]
+	}
+	v.Params.DecodeMatrix[15] = 1
+}
+
+func (v *VertexTable) layout(data []byte, count uint32, numRgbaPerVertex uint32) []byte {
+	v.Count = count
+	v.NumRgbaPerVertex = numRgbaPerVertex
+
+	nExtraRgba := uint32(len(data)+3)/4 - count*numRgbaPerVertex
+	dims := ComputeDimensions(count, numRgbaPerVertex, nExtraRgba)
+	v.Width = dims.Width
+	v.Height = dims.Height
+
+	if size := int(dims.Width * dims.Height * 4); size > len(data) {
+		data = append(data, make([]byte, size-len(data))...)
+	}
+	return data
 }
 
 func (v *VertexTable) GetPosQParams3d() *QParams3d {
@@ -76,6 +206,7 @@ type Primitive struct {
 	IsPlanar              *bool       `json:"isPlanar,omitempty"`
 	ViewIndependentOrigin *[3]float32 `json:"viewIndependentOrigin,omitempty"`
 	Instances             *Instances  `json:"instances,omitempty"`
+	digest                []byte
 }
 
 type SegmentEdges struct {
@@ -162,6 +293,10 @@ func (r *Range2d) Extend(xyz [2]float32) {
 
 func CreateRange2d(points [][2]float32) *Range2d {
 	result := &Range2d{}
+	if len(points) > 0 {
+		result.Low = points[0]
+		result.High = points[0]
+	}
 	for _, point := range points {
 		result.Extend(point)
 	}
@@ -202,6 +337,10 @@ func (r *Range3d) Extend(xyz [3]float32) {
 
 func CreateRange3d(points [][3]float32) *Range3d {
 	result := &Range3d{}
+	if len(points) > 0 {
+		result.Low = points[0]
+		result.High = points[0]
+	}
 	for _, point := range points {
 		result.Extend(point)
 	}
@@ -222,6 +361,19 @@ type AreaPattern struct {
 	Range                 Range3d     `json:"range"`
 	SymbolTranslation     [3]float32  `json:"symbolTranslation"`
 	ViewIndependentOrigin *[3]float32 `json:"viewIndependentOrigin"`
+	Members               Members     `json:"-"`
+}
+
+func (p *AreaPattern) UnmarshalJSON(data []byte) error {
+	type alias AreaPattern
+	var err error
+	p.Members, err = unmarshalMembers(data, (*alias)(p))
+	return err
+}
+
+func (p AreaPattern) MarshalJSON() ([]byte, error) {
+	type alias AreaPattern
+	return marshalMembers(alias(p), p.Members)
 }
 
 type SurfaceType uint32
@@ -234,14 +386,24 @@ const (
 	ST_VolumeClassifier SurfaceType = 4
 )
 
+func (t SurfaceType) NumRgbaPerVertex() uint32 {
+	switch t {
+	case ST_Lit, ST_Textured, ST_TexturedLit:
+		return 4
+	}
+	return 3
+}
+
 type Surface struct {
 	Type                 SurfaceType `json:"type,omitempty"`
 	Indices              string      `json:"indices,omitempty"`
 	AlwaysDisplayTexture *bool       `json:"alwaysDisplayTexture,omitempty"`
-	UVParams             *struct {
-		DecodedMin []float32 `json:"decodedMin"`
-		DecodedMax []float32 `json:"decodedMax"`
-	} `json:"uvParams"`
+	UVParams             *UVParams   `json:"uvParams"`
+}
+
+type UVParams struct {
+	DecodedMin []float32 `json:"decodedMin"`
+	DecodedMax []float32 `json:"decodedMax"`
 }
 
 func (v *Surface) GetUvQParams2d() *QParams2d {
@@ -255,9 +417,9 @@ func (v *Surface) GetUvQParams2d() *QParams2d {
 }
 
 type AuxChannel struct {
-	Name    string   `json:"name"`
-	Inputs  []uint32 `json:"inputs"`
-	Indices []uint32 `json:"indices"`
+	Name    string    `json:"name"`
+	Inputs  []float32 `json:"inputs"`
+	Indices []uint32  `json:"indices"`
 }
 
 type QuantizedAuxChannel struct {
@@ -276,6 +438,7 @@ type AuxChannelTable struct {
 	Normals           []AuxChannel          `json:"normals,omitempty"`
 	Params            []QuantizedAuxChannel `json:"params,omitempty"`
 	AuxChannelData    []byte                `json:"-"`
+	Channels          *AuxChannels          `json:"-"`
 }
 
 type MeshPrimitive struct {
@@ -286,13 +449,40 @@ type MeshPrimitive struct {
 	AuxChannels *AuxChannelTable `json:"auxChannels,omitempty"`
 	AreaPattern *AreaPattern     `json:"areaPattern,omitempty"`
 	Data        *MeshData        `json:"-"`
+	EdgeData    *EdgeData        `json:"-"`
+	Members     Members          `json:"-"`
+}
+
+func (p *MeshPrimitive) UnmarshalJSON(data []byte) error {
+	type alias MeshPrimitive
+	var err error
+	p.Members, err = unmarshalMembers(data, (*alias)(p))
+	return err
+}
+
+func (p MeshPrimitive) MarshalJSON() ([]byte, error) {
+	type alias MeshPrimitive
+	return marshalMembers(alias(p), p.Members)
 }
 
 type PolylinePrimitive struct {
 	Primitive
 	Polyline
-	Type PrimitiveType `json:"type"` // Polyline
-	Data *PolylineData `json:"-"`
+	Type    PrimitiveType `json:"type"` // Polyline
+	Data    *PolylineData `json:"-"`
+	Members Members       `json:"-"`
+}
+
+func (p *PolylinePrimitive) UnmarshalJSON(data []byte) error {
+	type alias PolylinePrimitive
+	var err error
+	p.Members, err = unmarshalMembers(data, (*alias)(p))
+	return err
+}
+
+func (p PolylinePrimitive) MarshalJSON() ([]byte, error) {
+	type alias PolylinePrimitive
+	return marshalMembers(alias(p), p.Members)
 }
 
 type PointStringPrimitive struct {
@@ -300,132 +490,112 @@ type PointStringPrimitive struct {
 	Type    PrimitiveType    `json:"type"` // Point
 	Indices string           `json:"indices,omitempty"`
 	Data    *PointStringData `json:"-"`
+	Members Members          `json:"-"`
 }
 
-type Mesh struct {
-	Primitives interface{} `json:"primitives,omitempty"`
-	Layer      string      `json:"layer,omitempty"`
+func (p *PointStringPrimitive) UnmarshalJSON(data []byte) error {
+	type alias PointStringPrimitive
+	var err error
+	p.Members, err = unmarshalMembers(data, (*alias)(p))
+	return err
 }
 
-func (p *Mesh) UnmarshalJSON(data []byte) error {
-	type _mesh struct {
-		Primitives []struct {
-			Type interface{} `json:"type,omitempty"`
-		} `json:"primitives,omitempty"`
-		Layer string `json:"layer,omitempty"`
+func (p PointStringPrimitive) MarshalJSON() ([]byte, error) {
+	type alias PointStringPrimitive
+	return marshalMembers(alias(p), p.Members)
+}
+
+type PrimitiveItem interface {
+	GetPrimitive() *Primitive
+}
+
+func (p *MeshPrimitive) GetPrimitive() *Primitive {
+	return &p.Primitive
+}
+
+func (p *PolylinePrimitive) GetPrimitive() *Primitive {
+	return &p.Primitive
+}
+
+func (p *PointStringPrimitive) GetPrimitive() *Primitive {
+	return &p.Primitive
+}
+
+func (p *AreaPattern) GetPrimitive() *Primitive {
+	return nil
+}
+
+func unmarshalPrimitiveItem(data []byte) (PrimitiveItem, error) {
+	var head struct {
+		Type interface{} `json:"type"`
 	}
-	var m _mesh
-	err := json.Unmarshal(data, &m)
-	if err != nil {
-		return err
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, err
 	}
 
-	if len(m.Primitives) > 0 {
-		if t, ok := m.Primitives[0].Type.(string); ok && t == "areaPattern" {
-			type a_mesh struct {
-				Primitives []AreaPattern `json:"primitives,omitempty"`
-				Layer      string        `json:"layer,omitempty"`
-			}
-			var m a_mesh
-			err := json.Unmarshal(data, &m)
-			if err != nil {
-				return err
-			}
-			p.Primitives = m.Primitives
-			p.Layer = m.Layer
-		} else if t, ok := m.Primitives[0].Type.(float64); ok {
-			switch PrimitiveType(t) {
-			case PT_Mesh:
-				type m_mesh struct {
-					Primitives []MeshPrimitive `json:"primitives,omitempty"`
-					Layer      string          `json:"layer,omitempty"`
-				}
-				var m m_mesh
-				err := json.Unmarshal(data, &m)
-				if err != nil {
-					return err
-				}
-				p.Primitives = m.Primitives
-				p.Layer = m.Layer
-			case PT_Polyline:
-				type p_mesh struct {
-					Primitives []PolylinePrimitive `json:"primitives,omitempty"`
-					Layer      string              `json:"layer,omitempty"`
-				}
-				var m p_mesh
-				err := json.Unmarshal(data, &m)
-				if err != nil {
-					return err
-				}
-				p.Primitives = m.Primitives
-				p.Layer = m.Layer
-			case PT_Point:
-				type p_mesh struct {
-					Primitives []PointStringPrimitive `json:"primitives,omitempty"`
-					Layer      string                 `json:"layer,omitempty"`
-				}
-				var m p_mesh
-				err := json.Unmarshal(data, &m)
-				if err != nil {
-					return err
-				}
-				p.Primitives = m.Primitives
-				p.Layer = m.Layer
-			}
+	var item PrimitiveItem
+	switch t := head.Type.(type) {
+	case string:
+		if t != "areaPattern" {
+			return nil, fmt.Errorf("unknown primitive type %q", t)
+		}
+		item = &AreaPattern{}
+	case float64:
+		switch PrimitiveType(t) {
+		case PT_Mesh:
+			item = &MeshPrimitive{}
+		case PT_Polyline:
+			item = &PolylinePrimitive{}
+		case PT_Point:
+			item = &PointStringPrimitive{}
+		default:
+			return nil, fmt.Errorf("unknown primitive type %v", t)
 		}
+	default:
+		return nil, errors.New("primitive type missing")
 	}
 
-	return nil
+	if err := json.Unmarshal(data, item); err != nil {
+		return nil, err
+	}
+	return item, nil
 }
 
-func (p *Mesh) MarshalJSON() ([]byte, error) {
-	switch privs := p.Primitives.(type) {
-	case []AreaPattern:
-		type m_mesh struct {
-			Primitives []AreaPattern `json:"primitives,omitempty"`
-			Layer      string        `json:"layer,omitempty"`
-		}
-		m := &m_mesh{Primitives: privs, Layer: p.Layer}
-		b, err := json.Marshal(m)
-		if err != nil {
-			return nil, err
-		}
-		return b, nil
-	case []MeshPrimitive:
-		type m_mesh struct {
-			Primitives []MeshPrimitive `json:"primitives,omitempty"`
-			Layer      string          `json:"layer,omitempty"`
-		}
-		m := &m_mesh{Primitives: privs, Layer: p.Layer}
-		b, err := json.Marshal(m)
-		if err != nil {
-			return nil, err
-		}
-		return b, nil
-	case []PolylinePrimitive:
-		type p_mesh struct {
-			Primitives []PolylinePrimitive `json:"primitives,omitempty"`
-			Layer      string              `json:"layer,omitempty"`
-		}
-		m := &p_mesh{Primitives: privs, Layer: p.Layer}
-		b, err := json.Marshal(m)
-		if err != nil {
-			return nil, err
-		}
-		return b, nil
-	case []PointStringPrimitive:
-		type p_mesh struct {
-			Primitives []PointStringPrimitive `json:"primitives,omitempty"`
-			Layer      string                 `json:"layer,omitempty"`
-		}
-		m := &p_mesh{Primitives: privs, Layer: p.Layer}
-		b, err := json.Marshal(m)
+func unmarshalPrimitiveItems(raws []json.RawMessage) ([]PrimitiveItem, error) {
+	if raws == nil {
+		return nil, nil
+	}
+	items := make([]PrimitiveItem, len(raws))
+	for i := range raws {
+		item, err := unmarshalPrimitiveItem(raws[i])
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("primitive %d: %w", i, err)
 		}
-		return b, nil
+		items[i] = item
 	}
-	return nil, errors.New("error")
+	return items, nil
+}
+
+type Mesh struct {
+	Primitives []PrimitiveItem `json:"primitives,omitempty"`
+	Layer      string          `json:"layer,omitempty"`
+}
+
+func (p *Mesh) UnmarshalJSON(data []byte) error {
+	var m struct {
+		Primitives []json.RawMessage `json:"primitives,omitempty"`
+		Layer      string            `json:"layer,omitempty"`
+	}
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return err
+	}
+	p.Primitives, err = unmarshalPrimitiveItems(m.Primitives)
+	if err != nil {
+		return err
+	}
+	p.Layer = m.Layer
+	return nil
 }
 
 type Buffer struct {
@@ -446,94 +616,19 @@ type BufferView struct {
 }
 
 type AreaPatternSymbol struct {
-	Primitives interface{} `json:"primitives,omitempty"`
+	Primitives []PrimitiveItem `json:"primitives,omitempty"`
 }
 
 func (p *AreaPatternSymbol) UnmarshalJSON(data []byte) error {
-	type _mesh struct {
-		Primitives []struct {
-			Type PrimitiveType `json:"type,omitempty"`
-		} `json:"primitives,omitempty"`
+	var m struct {
+		Primitives []json.RawMessage `json:"primitives,omitempty"`
 	}
-	var m _mesh
 	err := json.Unmarshal(data, &m)
 	if err != nil {
 		return err
 	}
-	if len(m.Primitives) > 0 {
-		switch m.Primitives[0].Type {
-		case PT_Mesh:
-			type m_mesh struct {
-				Primitives []MeshPrimitive `json:"primitives,omitempty"`
-				Layer      string          `json:"layer,omitempty"`
-			}
-			var m m_mesh
-			err := json.Unmarshal(data, &m)
-			if err != nil {
-				return err
-			}
-			p.Primitives = m.Primitives
-		case PT_Polyline:
-			type p_mesh struct {
-				Primitives []PolylinePrimitive `json:"primitives,omitempty"`
-				Layer      string              `json:"layer,omitempty"`
-			}
-			var m p_mesh
-			err := json.Unmarshal(data, &m)
-			if err != nil {
-				return err
-			}
-			p.Primitives = m.Primitives
-		case PT_Point:
-			type p_mesh struct {
-				Primitives []PointStringPrimitive `json:"primitives,omitempty"`
-				Layer      string                 `json:"layer,omitempty"`
-			}
-			var m p_mesh
-			err := json.Unmarshal(data, &m)
-			if err != nil {
-				return err
-			}
-			p.Primitives = m.Primitives
-		}
-	}
-	return nil
-}
-
-func (p *AreaPatternSymbol) MarshalJSON() ([]byte, error) {
-	switch privs := p.Primitives.(type) {
-	case []MeshPrimitive:
-		type m_mesh struct {
-			Primitives []MeshPrimitive `json:"primitives,omitempty"`
-		}
-		m := &m_mesh{Primitives: privs}
-		b, err := json.Marshal(m)
-		if err != nil {
-			return nil, err
-		}
-		return b, nil
-	case []PolylinePrimitive:
-		type p_mesh struct {
-			Primitives []PolylinePrimitive `json:"primitives,omitempty"`
-		}
-		m := &p_mesh{Primitives: privs}
-		b, err := json.Marshal(m)
-		if err != nil {
-			return nil, err
-		}
-		return b, nil
-	case []PointStringPrimitive:
-		type p_mesh struct {
-			Primitives []PointStringPrimitive `json:"primitives,omitempty"`
-		}
-		m := &p_mesh{Primitives: privs}
-		b, err := json.Marshal(m)
-		if err != nil {
-			return nil, err
-		}
-		return b, nil
-	}
-	return nil, errors.New("error")
+	p.Primitives, err = unmarshalPrimitiveItems(m.Primitives)
+	return err
 }
 
 type RenderTexture struct {
@@ -544,6 +639,19 @@ type RenderTexture struct {
 	IsGlyph       bool        `json:"isGlyph"`
 	IsTileSection bool        `json:"isTileSection"`
 	TextureData   image.Image `json:"-"`
+	Members       Members     `json:"-"`
+}
+
+func (p *RenderTexture) UnmarshalJSON(data []byte) error {
+	type alias RenderTexture
+	var err error
+	p.Members, err = unmarshalMembers(data, (*alias)(p))
+	return err
+}
+
+func (p RenderTexture) MarshalJSON() ([]byte, error) {
+	type alias RenderTexture
+	return marshalMembers(alias(p), p.Members)
 }
 
 type TextureMappingMode int32
@@ -569,6 +677,19 @@ type Texture struct {
 		Weight        float64            `json:"weight"`
 		WorldMapping  bool               `json:"worldMapping"`
 	} `json:"params"`
+	Members Members `json:"-"`
+}
+
+func (p *Texture) UnmarshalJSON(data []byte) error {
+	type alias Texture
+	var err error
+	p.Members, err = unmarshalMembers(data, (*alias)(p))
+	return err
+}
+
+func (p Texture) MarshalJSON() ([]byte, error) {
+	type alias Texture
+	return marshalMembers(alias(p), p.Members)
 }
 
 type TextureMapping struct {
@@ -590,6 +711,19 @@ type RenderMaterial struct {
 	SpecularExponent float32         `json:"specularExponent"`
 	Transparency     *float32        `json:"transparency,omitempty"`
 	TextureMapping   *TextureMapping `json:"textureMapping"`
+	Members          Members         `json:"-"`
+}
+
+func (p *RenderMaterial) UnmarshalJSON(data []byte) error {
+	type alias RenderMaterial
+	var err error
+	p.Members, err = unmarshalMembers(data, (*alias)(p))
+	return err
+}
+
+func (p RenderMaterial) MarshalJSON() ([]byte, error) {
+	type alias RenderMaterial
+	return marshalMembers(alias(p), p.Members)
 }
 
 type Scene struct {
@@ -608,6 +742,19 @@ type Material struct {
 	SubCategoryId  string   `json:"subCategoryId"`
 	Texture        *Texture `json:"texture,omitempty"`
 	Type           uint32   `json:"type"`
+	Members        Members  `json:"-"`
+}
+
+func (p *Material) UnmarshalJSON(data []byte) error {
+	type alias Material
+	var err error
+	p.Members, err = unmarshalMembers(data, (*alias)(p))
+	return err
+}
+
+func (p Material) MarshalJSON() ([]byte, error) {
+	type alias Material
+	return marshalMembers(alias(p), p.Members)
 }
 
 type AnimationNodes struct {
@@ -617,18 +764,33 @@ type AnimationNodes struct {
 }
 
 type Document struct {
-	Buffers         map[string]*Buffer            `json:"buffers,omitempty" validate:"dive"`
-	BufferViews     map[string]*BufferView        `json:"bufferViews,omitempty" validate:"dive"`
-	Materials       map[string]*Material          `json:"materials,omitempty" validate:"dive"`
-	Meshes          map[string]*Mesh              `json:"meshes,omitempty" validate:"dive"`
-	Nodes           map[string]string             `json:"nodes,omitempty" validate:"dive"`
-	Scene           *string                       `json:"scene,omitempty"`
-	Scenes          map[string]*Scene             `json:"scenes,omitempty" validate:"dive"`
-	NamedTextures   map[string]*RenderTexture     `json:"namedTextures,omitempty" validate:"dive"`
-	RenderMaterials map[string]*RenderMaterial    `json:"renderMaterials,omitempty" validate:"dive"`
-	AnimationNodes  *AnimationNodes               `json:"animationNodes,omitempty"`
-	PatternSymbols  map[string]*AreaPatternSymbol `json:"patternSymbols,omitempty"`
-	chunks          []chunkData                   `json:"-"`
+	Buffers          map[string]*Buffer            `json:"buffers,omitempty" validate:"dive"`
+	BufferViews      map[string]*BufferView        `json:"bufferViews,omitempty" validate:"dive"`
+	Materials        map[string]*Material          `json:"materials,omitempty" validate:"dive"`
+	Meshes           map[string]*Mesh              `json:"meshes,omitempty" validate:"dive"`
+	Nodes            map[string]string             `json:"nodes,omitempty" validate:"dive"`
+	Scene            *string                       `json:"scene,omitempty"`
+	Scenes           map[string]*Scene             `json:"scenes,omitempty" validate:"dive"`
+	NamedTextures    map[string]*RenderTexture     `json:"namedTextures,omitempty" validate:"dive"`
+	RenderMaterials  map[string]*RenderMaterial    `json:"renderMaterials,omitempty" validate:"dive"`
+	AnimationNodes   *AnimationNodes               `json:"animationNodes,omitempty"`
+	PatternSymbols   map[string]*AreaPatternSymbol `json:"patternSymbols,omitempty"`
+	ExtensionsUsed   []string                      `json:"extensionsUsed,omitempty"`
+	GlExtensionsUsed []string                      `json:"glExtensionsUsed,omitempty"`
+	Members          Members                       `json:"-"`
+	chunks           []chunkData                   `json:"-"`
+}
+
+func (doc *Document) UnmarshalJSON(data []byte) error {
+	type alias Document
+	var err error
+	doc.Members, err = unmarshalMembers(data, (*alias)(doc))
+	return err
+}
+
+func (doc Document) MarshalJSON() ([]byte, error) {
+	type alias Document
+	return marshalMembers(alias(doc), doc.Members)
 }
 
 func newString(s string) *string {
@@ -642,6 +804,16 @@ func NewDocument() *Document {
 	}
 }
 
+func (doc *Document) updateExtensionsUsed(asBinary bool) {
+	if asBinary {
+		doc.ExtensionsUsed = appendMissing(doc.ExtensionsUsed, "KHR_binary_glTF")
+	} else {
+		doc.ExtensionsUsed = removeAll(doc.ExtensionsUsed, "KHR_binary_glTF")
+	}
+	doc.ExtensionsUsed = appendMissing(doc.ExtensionsUsed, "WEB3D_quantized_attributes")
+	doc.GlExtensionsUsed = appendMissing(doc.GlExtensionsUsed, "OES_element_index_uint")
+}
+
 func (doc *Document) FindBuffer(bufferView string) []byte {
 	for i := range doc.chunks {
 		if doc.chunks[i].name == bufferView {
@@ -651,66 +823,157 @@ func (doc *Document) FindBuffer(bufferView string) []byte {
 	return nil
 }
 
-func (doc *Document) decodeChunkData(data []byte) {
-	chunkMap := make(map[string]*chunkData)
-	for k, v := range doc.BufferViews {
-		byteOffset := int(v.ByteOffset)
-		byteLength := int(v.ByteLength)
-		cd := chunkData{name: k, data: data[byteOffset : byteOffset+byteLength]}
-		doc.chunks = append(doc.chunks, cd)
-		chunkMap[k] = &cd
+func digestPrimitive(item PrimitiveItem) []byte {
+	prim := item.GetPrimitive()
+	if prim == nil {
+		return nil
 	}
+	parts := []interface{}{prim.Vertices.ColorTable}
+	if prim.Instances != nil {
+		parts = append(parts, prim.Instances.Data)
+	}
+	switch p := item.(type) {
+	case *MeshPrimitive:
+		parts = append(parts, p.Data, p.EdgeData)
+		if p.AuxChannels != nil {
+			parts = append(parts, p.AuxChannels.Channels)
+		}
+	case *PolylinePrimitive:
+		parts = append(parts, p.Data)
+	case *PointStringPrimitive:
+		parts = append(parts, p.Data)
+	}
+	return digestValues(parts...)
+}
 
-	for _, m := range doc.Meshes {
-		switch privs := m.Primitives.(type) {
-		case []MeshPrimitive:
-			for i := range privs {
-				privs[i].Data = &MeshData{Type: privs[i].Surface.Type}
+func isUnchanged(item PrimitiveItem) bool {
+	prim := item.GetPrimitive()
+	return prim != nil && prim.digest != nil && bytes.Equal(prim.digest, digestPrimitive(item))
+}
 
-				uvq := privs[i].Surface.GetUvQParams2d()
-				posq := privs[i].Vertices.GetPosQParams3d()
+// setDigest records the state of a primitive whose buffers match its data,
+// for a later passthrough encoding to compare against.
+func setDigest(item PrimitiveItem) {
+	if prim := item.GetPrimitive(); prim != nil {
+		prim.digest = digestPrimitive(item)
+	}
+}
 
-				if cd, ok := chunkMap[privs[i].Surface.Indices]; ok {
-					privs[i].Data.DecodeIndices(cd.data)
-				}
+func (doc *Document) decodePrimitive(item PrimitiveItem, chunkMap map[string]*chunkData) {
+	switch p := item.(type) {
+	case *MeshPrimitive:
+		p.Data = &MeshData{Type: p.Surface.Type}
 
-				if cd, ok := chunkMap[privs[i].Vertices.BufferView]; ok {
-					privs[i].Data.DecodeVertexs(cd.data, privs[i].Vertices.Count)
-				}
+		uvq := p.Surface.GetUvQParams2d()
+		posq := p.Vertices.GetPosQParams3d()
 
-				privs[i].Data.UnQuantize(posq, uvq)
-			}
-		case []PolylinePrimitive:
-			for i := range privs {
-				privs[i].Data = &PolylineData{}
+		if cd, ok := chunkMap[p.Surface.Indices]; ok {
+			p.Data.DecodeIndices(cd.data)
+		}
 
-				posq := privs[i].Vertices.GetPosQParams3d()
+		if cd, ok := chunkMap[p.Vertices.BufferView]; ok {
+			p.Data.DecodeVertexs(cd.data, p.Vertices.Count)
+			p.Vertices.DecodeColorTable(cd.data)
 
-				if cd, ok := chunkMap[privs[i].Indices]; ok {
-					privs[i].Data.DecodeIndices(cd.data)
+			if atlas := p.Vertices.MaterialAtlas; atlas != nil {
+				if offset := p.Vertices.materialAtlasOffset(); offset <= len(cd.data) {
+					p.Data.DecodeMaterialAtlas(cd.data[offset:], atlas.NumMaterials)
 				}
+			}
+		}
 
-				if cd, ok := chunkMap[privs[i].Vertices.BufferView]; ok {
-					privs[i].Data.DecodeVertexs(cd.data)
-				}
+		p.Data.UnQuantize(posq, uvq)
+
+		if p.Edges != nil {
+			p.EdgeData = p.Edges.decodeData(chunkMap)
+		}
 
-				privs[i].Data.UnQuantize(posq)
+		if p.AuxChannels != nil {
+			if cd, ok := chunkMap[p.AuxChannels.BufferView]; ok {
+				p.AuxChannels.Decode(cd.data)
 			}
-		case []PointStringPrimitive:
-			for i := range privs {
-				privs[i].Data = &PointStringData{}
+		}
 
-				posq := privs[i].Vertices.GetPosQParams3d()
+		if p.Instances != nil {
+			p.Instances.decodeData(chunkMap)
+		}
+	case *PolylinePrimitive:
+		p.Data = &PolylineData{}
 
-				if cd, ok := chunkMap[privs[i].Indices]; ok {
-					privs[i].Data.DecodeIndices(cd.data)
-				}
+		posq := p.Vertices.GetPosQParams3d()
 
-				if cd, ok := chunkMap[privs[i].Vertices.BufferView]; ok {
-					privs[i].Data.DecodeVertexs(cd.data)
-				}
+		if cd, ok := chunkMap[p.Indices]; ok {
+			p.Data.DecodeIndices(cd.data)
+		}
+
+		prevIndices, ok1 := chunkMap[p.PrevIndices]
+		nextIndicesAndParams, ok2 := chunkMap[p.NextIndicesAndParams]
+		if ok1 && ok2 {
+			p.Data.DecodePolylineParams(prevIndices.data, nextIndicesAndParams.data)
+		}
+
+		if cd, ok := chunkMap[p.Vertices.BufferView]; ok {
+			p.Data.DecodeVertexs(p.Vertices.vertexData(cd.data))
+			p.Vertices.DecodeColorTable(cd.data)
+		}
+
+		p.Data.UnQuantize(posq)
+
+		if p.Instances != nil {
+			p.Instances.decodeData(chunkMap)
+		}
+	case *PointStringPrimitive:
+		p.Data = &PointStringData{}
+
+		posq := p.Vertices.GetPosQParams3d()
+
+		if cd, ok := chunkMap[p.Indices]; ok {
+			p.Data.DecodeIndices(cd.data)
+		}
 
-				privs[i].Data.UnQuantize(posq)
+		if cd, ok := chunkMap[p.Vertices.BufferView]; ok {
+			p.Data.DecodeVertexs(p.Vertices.vertexData(cd.data))
+			p.Vertices.DecodeColorTable(cd.data)
+		}
+
+		p.Data.UnQuantize(posq)
+
+		if p.Instances != nil {
+			p.Instances.decodeData(chunkMap)
+		}
+	}
+}
+
+func (doc *Document) decodeChunkData(data []byte, passthrough bool) {
+	names := sortedKeys(doc.BufferViews)
+	sort.SliceStable(names, func(i, j int) bool {
+		return doc.BufferViews[names[i]].ByteOffset < doc.BufferViews[names[j]].ByteOffset
+	})
+
+	doc.chunks = nil
+	chunkMap := make(map[string]*chunkData)
+	for _, k := range names {
+		v := doc.BufferViews[k]
+		byteOffset := int(v.ByteOffset)
+		byteLength := int(v.ByteLength)
+		cd := chunkData{name: k, data: data[byteOffset : byteOffset+byteLength : byteOffset+byteLength]}
+		doc.chunks = append(doc.chunks, cd)
+		chunkMap[k] = &cd
+	}
+
+	for _, k := range sortedKeys(doc.Meshes) {
+		for _, item := range doc.Meshes[k].Primitives {
+			doc.decodePrimitive(item, chunkMap)
+			if passthrough {
+				setDigest(item)
+			}
+		}
+	}
+	for _, k := range sortedKeys(doc.PatternSymbols) {
+		for _, item := range doc.PatternSymbols[k].Primitives {
+			doc.decodePrimitive(item, chunkMap)
+			if passthrough {
+				setDigest(item)
 			}
 		}
 	}
@@ -755,105 +1018,253 @@ func (doc *Document) decodeChunkData(data []byte) {
 	}
 }
 
-func (doc *Document) encodeChunkData() ([][]byte, uint32) {
+func (doc *Document) wantJoints(material string) bool {
+	if m, ok := doc.Materials[material]; ok && m.LineWidth != nil {
+		return wantJointTriangles(*m.LineWidth, false)
+	}
+	return false
+}
+
+func (doc *Document) encodePrimitive(item PrimitiveItem, nextBufferName func() string) error {
+	switch p := item.(type) {
+	case *MeshPrimitive:
+		if p.Data != nil {
+			posr, uvr := p.Data.Quantize()
+
+			if p.Surface.Indices == "" {
+				p.Surface.Indices = nextBufferName()
+			}
+			doc.chunks = append(doc.chunks, chunkData{name: p.Surface.Indices, data: p.Data.EncodeIndices()})
+
+			if uvr != nil {
+				if p.Surface.UVParams == nil {
+					p.Surface.UVParams = &UVParams{}
+				}
+				p.Surface.UVParams.DecodedMin = uvr.Low[:]
+				p.Surface.UVParams.DecodedMax = uvr.High[:]
+			}
+
+			if p.Vertices.BufferView == "" {
+				p.Vertices.BufferView = nextBufferName()
+			}
+			if err := p.Vertices.buildColorTable(p.Data.simpleVertexs()); err != nil {
+				return fmt.Errorf("imdl: encoding bufferView %q: %w", p.Vertices.BufferView, err)
+			}
+			vertexData := append(p.Data.EncodeVertexs(), p.Vertices.encodeColorTable()...)
+			if len(p.Data.Materials) > 0 {
+				if p.Vertices.MaterialAtlas == nil {
+					p.Vertices.MaterialAtlas = &MaterialAtlas{}
+				}
+				p.Vertices.MaterialAtlas.update(p.Data.Materials)
+				vertexData = append(vertexData, p.Data.EncodeMaterialAtlas()...)
+			}
+			vertexData = p.Vertices.layout(vertexData, uint32(len(p.Data.Vertexs)), p.Data.Type.NumRgbaPerVertex())
+			doc.chunks = append(doc.chunks, chunkData{name: p.Vertices.BufferView, data: vertexData})
+
+			if posr != nil {
+				p.Vertices.updateParams(posr)
+			}
+		}
+
+		if p.EdgeData != nil {
+			if p.EdgeData.IsEmpty() {
+				p.Edges = nil
+			} else {
+				if p.Edges == nil {
+					p.Edges = &MeshEdges{}
+				}
+				doc.chunks = append(doc.chunks, p.Edges.encodeData(p.EdgeData, nextBufferName)...)
+			}
+		}
+
+		if p.AuxChannels != nil && p.AuxChannels.Channels != nil && p.Data != nil {
+			p.AuxChannels.Encode(p.AuxChannels.Channels, uint32(len(p.Data.Vertexs)))
+			if p.AuxChannels.BufferView == "" {
+				p.AuxChannels.BufferView = nextBufferName()
+			}
+			doc.chunks = append(doc.chunks, chunkData{name: p.AuxChannels.BufferView, data: p.AuxChannels.AuxChannelData})
+		}
+
+		if p.Instances != nil && p.Instances.Data != nil {
+			doc.chunks = append(doc.chunks, p.Instances.encodeData(nextBufferName)...)
+		}
+	case *PolylinePrimitive:
+		if p.Data != nil {
+			if p.Data.NeedsTesselation() {
+				p.Data.Tesselate(doc.wantJoints(p.Material))
+			}
+			posr := p.Data.Quantize()
+
+			if p.Indices == "" {
+				p.Indices = nextBufferName()
+			}
+			doc.chunks = append(doc.chunks, chunkData{name: p.Indices, data: p.Data.EncodeIndices()})
+
+			if p.Data.HasPolylineParams() {
+				if p.PrevIndices == "" {
+					p.PrevIndices = nextBufferName()
+				}
+				doc.chunks = append(doc.chunks, chunkData{name: p.PrevIndices, data: p.Data.EncodePrevIndices()})
+				if p.NextIndicesAndParams == "" {
+					p.NextIndicesAndParams = nextBufferName()
+				}
+				doc.chunks = append(doc.chunks, chunkData{name: p.NextIndicesAndParams, data: p.Data.EncodeNextIndicesAndParams()})
+			}
+
+			if p.Vertices.BufferView == "" {
+				p.Vertices.BufferView = nextBufferName()
+			}
+			if err := p.Vertices.buildColorTable(p.Data.simpleVertexs()); err != nil {
+				return fmt.Errorf("imdl: encoding bufferView %q: %w", p.Vertices.BufferView, err)
+			}
+			vertexData := append(p.Data.EncodeVertexs(), p.Vertices.encodeColorTable()...)
+			vertexData = p.Vertices.layout(vertexData, uint32(len(p.Data.Vertexs)), 3)
+			doc.chunks = append(doc.chunks, chunkData{name: p.Vertices.BufferView, data: vertexData})
+
+			if posr != nil {
+				p.Vertices.updateParams(posr)
+			}
+		}
+
+		if p.Instances != nil && p.Instances.Data != nil {
+			doc.chunks = append(doc.chunks, p.Instances.encodeData(nextBufferName)...)
+		}
+	case *PointStringPrimitive:
+		if p.Data != nil {
+			posr := p.Data.Quantize()
+
+			if p.Indices == "" {
+				p.Indices = nextBufferName()
+			}
+			doc.chunks = append(doc.chunks, chunkData{name: p.Indices, data: p.Data.EncodeIndices()})
+			if p.Vertices.BufferView == "" {
+				p.Vertices.BufferView = nextBufferName()
+			}
+			if err := p.Vertices.buildColorTable(p.Data.simpleVertexs()); err != nil {
+				return fmt.Errorf("imdl: encoding bufferView %q: %w", p.Vertices.BufferView, err)
+			}
+			vertexData := append(p.Data.EncodeVertexs(), p.Vertices.encodeColorTable()...)
+			vertexData = p.Vertices.layout(vertexData, uint32(len(p.Data.Vertexs)), 3)
+			doc.chunks = append(doc.chunks, chunkData{name: p.Vertices.BufferView, data: vertexData})
+
+			if posr != nil {
+				p.Vertices.updateParams(posr)
+			}
+		}
+
+		if p.Instances != nil && p.Instances.Data != nil {
+			doc.chunks = append(doc.chunks, p.Instances.encodeData(nextBufferName)...)
+		}
+	}
+	return nil
+}
+
+// primitiveBufferViews returns the names of the bufferViews a primitive
+// refers to.
+func primitiveBufferViews(item PrimitiveItem) []string {
+	var names []string
+	switch p := item.(type) {
+	case *MeshPrimitive:
+		names = append(names, p.Surface.Indices, p.Vertices.BufferView)
+		if p.Edges != nil {
+			if e := p.Edges.Segments; e != nil {
+				names = append(names, e.Indices, e.EndPointAndQuadIndices)
+			}
+			if e := p.Edges.Silhouettes; e != nil {
+				names = append(names, e.Indices, e.EndPointAndQuadIndices, e.NormalPairs)
+			}
+			if e := p.Edges.Polylines; e != nil {
+				names = append(names, e.Indices, e.PrevIndices, e.NextIndicesAndParams)
+			}
+		}
+		if p.AuxChannels != nil {
+			names = append(names, p.AuxChannels.BufferView)
+		}
+	case *PolylinePrimitive:
+		names = append(names, p.Indices, p.PrevIndices, p.NextIndicesAndParams, p.Vertices.BufferView)
+	case *PointStringPrimitive:
+		names = append(names, p.Indices, p.Vertices.BufferView)
+	}
+	if prim := item.GetPrimitive(); prim != nil && prim.Instances != nil {
+		names = append(names, prim.Instances.FeatureIds, prim.Instances.Transforms, prim.Instances.SymbologyOverrides)
+	}
+	return names
+}
+
+// encodeChunkData encodes the primitive and texture buffers into doc.chunks
+// and lays them out in the binary buffer. It returns the padded length of
+// the binary buffer; the chunks themselves are written by writeChunks.
+func (doc *Document) encodeChunkData(passthrough bool) (uint32, error) {
 	doc.Buffers = make(map[string]*Buffer)
 	doc.BufferViews = make(map[string]*BufferView)
 
 	const bufferName = "binary_glTF"
 
+	decoded := doc.chunks
+	doc.chunks = nil
+
+	usedNames := make(map[string]bool)
+	for _, ck := range decoded {
+		usedNames[ck.name] = true
+	}
+
 	chunkid := 0
 
-	for _, m := range doc.Meshes {
-		switch privs := m.Primitives.(type) {
-		case []MeshPrimitive:
-			for i := range privs {
-				if privs[i].Data != nil {
-					posr, uvr := privs[i].Data.Quantize()
-
-					if privs[i].Surface.Indices == "" {
-						privs[i].Surface.Indices = fmt.Sprintf("buffer-%d", chunkid)
-						chunkid++
-					}
-					doc.chunks = append(doc.chunks, chunkData{name: privs[i].Surface.Indices, data: privs[i].Data.EncodeIndices()})
-
-					if uvr != nil {
-						privs[i].Surface.UVParams.DecodedMin = uvr.Low[:]
-						privs[i].Surface.UVParams.DecodedMax = uvr.High[:]
-					}
-
-					if privs[i].Vertices.BufferView == "" {
-						privs[i].Vertices.BufferView = fmt.Sprintf("buffer-%d", chunkid)
-						chunkid++
-					}
-					doc.chunks = append(doc.chunks, chunkData{name: privs[i].Vertices.BufferView, data: privs[i].Data.EncodeVertexs()})
-
-					if posr != nil {
-						privs[i].Vertices.Params.DecodedMin = posr.Low[:]
-						privs[i].Vertices.Params.DecodedMax = posr.High[:]
-					}
-				}
+	nextBufferName := func() string {
+		for {
+			name := fmt.Sprintf("buffer-%d", chunkid)
+			chunkid++
+			if !usedNames[name] {
+				usedNames[name] = true
+				return name
 			}
-		case []PolylinePrimitive:
-			for i := range privs {
-				if privs[i].Data != nil {
-					posr := privs[i].Data.Quantize()
-
-					if privs[i].Indices == "" {
-						privs[i].Indices = fmt.Sprintf("buffer-%d", chunkid)
-						chunkid++
-					}
-					doc.chunks = append(doc.chunks, chunkData{name: privs[i].Indices, data: privs[i].Data.EncodeIndices()})
-					if privs[i].Vertices.BufferView == "" {
-						privs[i].Vertices.BufferView = fmt.Sprintf("buffer-%d", chunkid)
-						chunkid++
-					}
-					doc.chunks = append(doc.chunks, chunkData{name: privs[i].Vertices.BufferView, data: privs[i].Data.EncodeVertexs()})
-
-					if posr != nil {
-						privs[i].Vertices.Params.DecodedMin = posr.Low[:]
-						privs[i].Vertices.Params.DecodedMax = posr.High[:]
-					}
-				}
+		}
+	}
+
+	for _, k := range sortedKeys(doc.Meshes) {
+		for _, item := range doc.Meshes[k].Primitives {
+			if passthrough && isUnchanged(item) {
+				continue
 			}
-		case []PointStringPrimitive:
-			for i := range privs {
-				if privs[i].Data != nil {
-					posr := privs[i].Data.Quantize()
-
-					if privs[i].Indices == "" {
-						privs[i].Indices = fmt.Sprintf("buffer-%d", chunkid)
-						chunkid++
-					}
-					doc.chunks = append(doc.chunks, chunkData{name: privs[i].Indices, data: privs[i].Data.EncodeIndices()})
-					if privs[i].Vertices.BufferView == "" {
-						privs[i].Vertices.BufferView = fmt.Sprintf("buffer-%d", chunkid)
-						chunkid++
-					}
-					doc.chunks = append(doc.chunks, chunkData{name: privs[i].Vertices.BufferView, data: privs[i].Data.EncodeVertexs()})
-
-					if posr != nil {
-						privs[i].Vertices.Params.DecodedMin = posr.Low[:]
-						privs[i].Vertices.Params.DecodedMax = posr.High[:]
-					}
-				}
+			if err := doc.encodePrimitive(item, nextBufferName); err != nil {
+				return 0, err
+			}
+			if passthrough {
+				setDigest(item)
+			}
+		}
+	}
+	for _, k := range sortedKeys(doc.PatternSymbols) {
+		for _, item := range doc.PatternSymbols[k].Primitives {
+			if passthrough && isUnchanged(item) {
+				continue
+			}
+			if err := doc.encodePrimitive(item, nextBufferName); err != nil {
+				return 0, err
+			}
+			if passthrough {
+				setDigest(item)
 			}
 		}
 	}
 
-	for _, t := range doc.NamedTextures {
+	for _, k := range sortedKeys(doc.NamedTextures) {
+		t := doc.NamedTextures[k]
 		if t.TextureData != nil {
 			if t.BufferView == "" {
-				t.BufferView = fmt.Sprintf("buffer-%d", chunkid)
-				chunkid++
+				t.BufferView = nextBufferName()
 			}
-			doc.chunks = append(doc.chunks, chunkData{name: t.BufferView, data: EncodeTexture(t.TextureData, TextureFormat(t.Format))})
+			data, err := EncodeTexture(t.TextureData, TextureFormat(t.Format))
+			if err != nil {
+				return 0, fmt.Errorf("imdl: encoding bufferView %q: %w", t.BufferView, err)
+			}
+			doc.chunks = append(doc.chunks, chunkData{name: t.BufferView, data: data})
 		}
 	}
 
 	if doc.AnimationNodes != nil {
 		if doc.AnimationNodes.BufferView == "" {
-			doc.AnimationNodes.BufferView = fmt.Sprintf("buffer-%d", chunkid)
-			chunkid++
+			doc.AnimationNodes.BufferView = nextBufferName()
 		}
 		switch t := doc.AnimationNodes.AnimationData.(type) {
 		case []byte:
@@ -890,18 +1301,80 @@ func (doc *Document) encodeChunkData() ([][]byte, uint32) {
 		}
 	}
 
-	offset := uint32(0)
+	// Only the decoded chunks still referenced as they were are carried over,
+	// the others belong to primitives that were re-encoded, flattened or
+	// removed.
+	keep := make(map[string]bool)
+	for _, k := range sortedKeys(doc.NamedTextures) {
+		if t := doc.NamedTextures[k]; t.TextureData == nil && t.BufferView != "" {
+			keep[t.BufferView] = true
+		}
+	}
+	keepPrimitives := func(items []PrimitiveItem) {
+		for _, item := range items {
+			switch p := item.(type) {
+			case *MeshPrimitive:
+				if p.AreaPattern != nil && p.AreaPattern.XYOffsets != "" {
+					keep[p.AreaPattern.XYOffsets] = true
+				}
+			case *AreaPattern:
+				if p.XYOffsets != "" {
+					keep[p.XYOffsets] = true
+				}
+			}
+			if passthrough && isUnchanged(item) {
+				for _, name := range primitiveBufferViews(item) {
+					keep[name] = true
+				}
+			}
+		}
+	}
+	for _, k := range sortedKeys(doc.Meshes) {
+		keepPrimitives(doc.Meshes[k].Primitives)
+	}
+	for _, k := range sortedKeys(doc.PatternSymbols) {
+		keepPrimitives(doc.PatternSymbols[k].Primitives)
+	}
+
+	encoded := make(map[string]bool)
+	for _, ck := range doc.chunks {
+		encoded[ck.name] = true
+	}
+	for _, ck := range decoded {
+		if keep[ck.name] && !encoded[ck.name] {
+			doc.chunks = append(doc.chunks, ck)
+		}
+	}
 
-	out := make([][]byte, len(doc.chunks))
+	offset := uint32(0)
 
-	for i, ck := range doc.chunks {
+	for _, ck := range doc.chunks {
 		dataLen := uint32(len(ck.data))
 		doc.BufferViews[ck.name] = &BufferView{Buffer: bufferName, ByteOffset: offset, ByteLength: dataLen}
-		out[i] = createPaddingBytes(ck.data, dataLen, 8, 0x20)
-		offset += uint32(len(out[i]))
+		offset += dataLen + calcPadding(dataLen, 8)
 	}
 
 	doc.Buffers[bufferName] = &Buffer{ByteLength: offset}
 
-	return out, offset
+	return offset, nil
+}
+
+// writeChunks streams the chunks laid out by encodeChunkData to w, padding
+// each one without copying its data.
+func (doc *Document) writeChunks(w io.Writer) error {
+	var padding [8]byte
+	for i := range padding {
+		padding[i] = 0x20
+	}
+	for _, ck := range doc.chunks {
+		if _, err := w.Write(ck.data); err != nil {
+			return fmt.Errorf("imdl: writing bufferView %q: %w", ck.name, err)
+		}
+		if n := calcPadding(uint32(len(ck.data)), 8); n > 0 {
+			if _, err := w.Write(padding[:n]); err != nil {
+				return fmt.Errorf("imdl: writing bufferView %q: %w", ck.name, err)
+			}
+		}
+	}
+	return nil
 }
@@ -1,6 +1,12 @@
 package imdl
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
 
 func TestEncodeVertexIndices(t *testing.T) {
 	indices := make([]uint32, 10)
@@ -101,3 +107,291 @@ func TestTexturedMeshDecoder(t *testing.T) {
 		}
 	}
 }
+
+func TestEdgeData(t *testing.T) {
+	data := &EdgeData{
+		Segments:    [][2]uint32{{0, 1}, {1, 2}},
+		Silhouettes: []SilhouetteEdge{{Indices: [2]uint32{2, 3}, Normals: [2]uint16{encodeXYZ(0, 0, 1), encodeXYZ(1, 0, 0)}}},
+		Polylines:   [][]uint32{{0, 1, 2, 3}, {4, 5, 6, 4}},
+	}
+
+	indices, endPoints := EncodeSegmentEdges(data.Segments)
+	if !reflect.DeepEqual(DecodeSegmentEdges(indices, endPoints), data.Segments) {
+		t.FailNow()
+	}
+
+	indices, endPoints, normalPairs := EncodeSilhouetteEdges(data.Silhouettes)
+	if !reflect.DeepEqual(DecodeSilhouetteEdges(indices, endPoints, normalPairs), data.Silhouettes) {
+		t.FailNow()
+	}
+
+	tp := TesselatePolylines(data.Polylines)
+	if !tp.IsValid() || !reflect.DeepEqual(tp.Lines(), data.Polylines) {
+		t.FailNow()
+	}
+}
+
+func TestTesselatedPolyline(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	tp := &TesselatedPolyline{}
+	tp.Decode(doc.FindBuffer("bvindices25"), doc.FindBuffer("bvprevIndices25"), doc.FindBuffer("bvnextIndicesAndParams25"))
+
+	lines := tp.Lines()
+	if len(lines) == 0 {
+		t.FailNow()
+	}
+
+	otp := TesselatePolylines(lines)
+	if !reflect.DeepEqual(tp, otp) {
+		t.FailNow()
+	}
+}
+
+func TestTesselatePolylineJoints(t *testing.T) {
+	points := [][3]float32{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {0, 1, 0}}
+	lines := [][]uint32{{0, 1, 2, 3, 0}}
+
+	tp := TesselatePolylines(lines)
+	if len(tp.Indices) != 4*6 || !reflect.DeepEqual(tp.Lines(), lines) {
+		t.FailNow()
+	}
+
+	jtp := TesselatePolylinesWithJoints(lines, points)
+	if len(jtp.Indices) != 4*(6+2*9) || !reflect.DeepEqual(jtp.Lines(), lines) {
+		t.FailNow()
+	}
+
+	joints := 0
+	for _, p := range jtp.Params {
+		if p.IsJoint() {
+			joints++
+		} else if p == PP_Square || p == PP_Miter {
+			t.FailNow()
+		}
+	}
+	if joints != 4*2*6 {
+		t.FailNow()
+	}
+
+	open := TesselatePolylinesWithJoints([][]uint32{{0, 1, 2}}, points)
+	if len(open.Indices) != 2*6+2*9 || open.Params[0] != PP_Square+PP_NegatePerp {
+		t.FailNow()
+	}
+}
+
+func TestAuxChannels(t *testing.T) {
+	channels := NewAuxChannels()
+	channels.Displacements["deform"] = []AuxVectorInput{
+		{Input: 0, Values: [][3]float32{{0, 0, 0}, {0, 0, 0}, {0, 0, 0}}},
+		{Input: 0.5, Values: [][3]float32{{1, 0, -1}, {0.5, 2, 0}, {0, 0, 4}}},
+	}
+	channels.Normals["normal"] = []AuxVectorInput{
+		{Input: 1, Values: [][3]float32{{0, 0, 1}, {1, 0, 0}, {0, -1, 0}}},
+	}
+	channels.Params["stress"] = []AuxScalarInput{
+		{Input: 2, Values: []float32{10, 20, 30}},
+	}
+
+	table := &AuxChannelTable{}
+	table.Encode(channels, 3)
+
+	if table.NumBytesPerVertex != 16 || table.Width*table.Height*4 < 3*16 || len(table.Displacements) != 1 {
+		t.FailNow()
+	}
+
+	otable := &AuxChannelTable{Count: table.Count, NumBytesPerVertex: table.NumBytesPerVertex, Displacements: table.Displacements, Normals: table.Normals, Params: table.Params}
+	otable.Decode(table.AuxChannelData)
+
+	deform := otable.Channels.Displacements["deform"]
+	if len(deform) != 2 || deform[1].Input != 0.5 || math.Abs(float64(deform[1].Values[2][2]-4)) > 1e-3 || math.Abs(float64(deform[1].Values[1][1]-2)) > 1e-3 {
+		t.FailNow()
+	}
+
+	normal := otable.Channels.Normals["normal"]
+	if len(normal) != 1 || math.Abs(float64(normal[0].Values[1][0]-1)) > 1e-2 {
+		t.FailNow()
+	}
+
+	stress := otable.Channels.Params["stress"]
+	if len(stress) != 1 || math.Abs(float64(stress[0].Values[1]-20)) > 1e-3 {
+		t.FailNow()
+	}
+}
+
+func TestComputeDimensions(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	// The fixture tables are single rows up to 4096 texels wide. Those with a
+	// material atlas hold more than the vertices and colors.
+	for _, item := range doc.Meshes[MESH_ROOT].Primitives {
+		v := item.GetPrimitive().Vertices
+		if v.MaterialAtlas != nil {
+			continue
+		}
+		numColors := uint32(0)
+		if v.NumColors != nil {
+			numColors = *v.NumColors
+		}
+		d := ComputeDimensions(v.Count, v.NumRgbaPerVertex, numColors)
+		if d.Width != v.Width || d.Height != v.Height {
+			t.FailNow()
+		}
+	}
+
+	if d := ComputeDimensions(1023, 4, 3); d.Width != 4095 || d.Height != 1 {
+		t.FailNow()
+	}
+	if d := ComputeDimensions(1024, 4, 0); d.Width != 64 || d.Height != 64 {
+		t.FailNow()
+	}
+}
+
+func TestMixedPrimitives(t *testing.T) {
+	src := []byte(`{"primitives":[{"type":1,"indices":"a"},{"type":0,"surface":{"type":1}},{"type":2,"indices":"b"},{"type":"areaPattern","symbolName":"s"}],"layer":"l"}`)
+
+	m := &Mesh{}
+	if err := json.Unmarshal(src, m); err != nil || len(m.Primitives) != 4 || m.Layer != "l" {
+		t.FailNow()
+	}
+
+	if _, ok := m.Primitives[0].(*PolylinePrimitive); !ok {
+		t.FailNow()
+	}
+	if p, ok := m.Primitives[1].(*MeshPrimitive); !ok || p.Surface.Type != ST_Lit {
+		t.FailNow()
+	}
+	if p, ok := m.Primitives[2].(*PointStringPrimitive); !ok || p.Indices != "b" {
+		t.FailNow()
+	}
+	if p, ok := m.Primitives[3].(*AreaPattern); !ok || p.SymbolName != "s" || p.GetPrimitive() != nil {
+		t.FailNow()
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.FailNow()
+	}
+
+	om := &Mesh{}
+	if err := json.Unmarshal(b, om); err != nil || !reflect.DeepEqual(m, om) {
+		t.FailNow()
+	}
+
+	if err := json.Unmarshal([]byte(`{"primitives":[{"type":7}]}`), &Mesh{}); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestUnknownMembers(t *testing.T) {
+	src := []byte(`{"categoryId":"0x1","materialId":"","subCategoryId":"0x2","type":0,"zeta":[1,2],"alpha":{"a":true}}`)
+
+	m := &Material{}
+	if err := json.Unmarshal(src, m); err != nil || m.CategoryId != "0x1" || len(m.Members) != 2 {
+		t.FailNow()
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil || string(b) != `{"categoryId":"0x1","materialId":"","subCategoryId":"0x2","type":0,"alpha":{"a":true},"zeta":[1,2]}` {
+		t.FailNow()
+	}
+
+	p := &PolylinePrimitive{}
+	if err := json.Unmarshal([]byte(`{"type":1,"indices":"a","material":"m","custom":3}`), p); err != nil || p.Material != "m" || p.Indices != "a" || len(p.Members) != 1 {
+		t.FailNow()
+	}
+	if b, err := json.Marshal(p); err != nil || !bytes.Contains(b, []byte(`"custom":3`)) {
+		t.FailNow()
+	}
+}
+
+func TestCreateInstances(t *testing.T) {
+	box := [][3]float32{{0, 0, 0}, {2, 0, 0}, {2, 1, 0}, {0, 1, 0}, {0, 0, 3}, {2, 0, 3}, {2, 1, 3}, {0, 1, 3}}
+	indices := []uint32{0, 1, 2, 0, 2, 3, 4, 5, 6, 4, 6, 7, 0, 1, 5, 0, 5, 4}
+
+	place := func(angle float64, offset [3]float32, feature uint32) *MeshPrimitive {
+		s, c := float32(math.Sin(angle)), float32(math.Cos(angle))
+		vertexs := make([]MeshVertex, len(box))
+		for i, p := range box {
+			vertexs[i].Pos = [3]float32{c*p[0] - s*p[1] + offset[0], s*p[0] + c*p[1] + offset[1], p[2] + offset[2]}
+		}
+		prim := &MeshPrimitive{Type: PT_Mesh, Surface: Surface{Type: ST_Unlit}}
+		prim.Material = "m"
+		prim.Vertices.FeatureIndexType = Uniform
+		prim.Vertices.FeatureId = &feature
+		prim.Data = &MeshData{Type: ST_Unlit, Indices: indices, Vertexs: vertexs}
+		return prim
+	}
+
+	other := place(0, [3]float32{}, 9)
+	other.Material = "n"
+	prims := []*MeshPrimitive{place(0, [3]float32{1, 2, 3}, 1), other, place(math.Pi/2, [3]float32{-5, 0, 1}, 2), place(1, [3]float32{10, 10, 10}, 3)}
+
+	doc := NewDocument()
+	doc.Meshes = map[string]*Mesh{"Mesh_Root": {Primitives: []PrimitiveItem{prims[0], prims[1], prims[2], prims[3]}}}
+
+	if doc.CreateInstances(InstancingOptions{MinInstanceCount: 4}) != 0 || len(doc.Meshes["Mesh_Root"].Primitives) != 4 {
+		t.FailNow()
+	}
+
+	if doc.CreateInstances(InstancingOptions{Tolerance: 1e-4, MinInstanceCount: 3}) != 1 || len(doc.Meshes["Mesh_Root"].Primitives) != 2 {
+		t.FailNow()
+	}
+
+	inst := doc.Meshes["Mesh_Root"].Primitives[0].(*MeshPrimitive)
+	if inst.Instances == nil || inst.Instances.Data.Count() != 3 || !reflect.DeepEqual(inst.Instances.Data.FeatureIds, []uint32{1, 2, 3}) {
+		t.FailNow()
+	}
+
+	center := inst.Instances.GetTransformCenter()
+	for k, src := range []*MeshPrimitive{prims[0], prims[2], prims[3]} {
+		for i, v := range inst.Data.Vertexs {
+			p := inst.Instances.Data.TransformPoint(k, center, v.Pos)
+			for j := 0; j < 3; j++ {
+				if math.Abs(float64(p[j]-src.Data.Vertexs[i].Pos[j])) > 1e-4 {
+					t.FailNow()
+				}
+			}
+		}
+	}
+
+	if doc.Meshes["Mesh_Root"].Primitives[1] != PrimitiveItem(other) {
+		t.FailNow()
+	}
+}
+
+func TestGenerateEdges(t *testing.T) {
+	// a unit square split into two coplanar triangles, plus a third triangle
+	// folded up along x = 1 and a fourth bent slightly along y = 1
+	pos := [][3]float32{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {0, 1, 0}, {1, 0, 1}, {0, 2, 0.1}, {1, 1, 0}}
+	data := &MeshData{Type: ST_Unlit, Indices: []uint32{0, 1, 2, 0, 2, 3, 1, 4, 6, 3, 2, 5}}
+	for _, p := range pos {
+		data.Vertexs = append(data.Vertexs, MeshVertex{SimpleVertex: SimpleVertex{Pos: p}})
+	}
+
+	edges := data.GenerateEdges(math.Pi / 4)
+
+	hard := false
+	for _, s := range edges.Segments {
+		if (s[0] == 1 && s[1] == 2) || (s[0] == 2 && s[1] == 1) {
+			hard = true
+		}
+		if (s[0] == 0 && s[1] == 2) || (s[0] == 2 && s[1] == 0) {
+			t.FailNow()
+		}
+	}
+	if !hard || len(edges.Segments) != 7 || len(edges.Silhouettes) != 1 {
+		t.FailNow()
+	}
+
+	n := edges.Silhouettes[0].DecodeNormals()
+	if n[0][2] < 0.99 || n[1][2] < 0.9 || n[1][2] > 0.999 {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,291 @@
+package imdl
+
+import "math"
+
+type SilhouetteEdge struct {
+	Indices [2]uint32
+	Normals [2]uint16
+}
+
+func (e *SilhouetteEdge) DecodeNormals() [2][3]float32 {
+	return [2][3]float32{decodeValue(e.Normals[0]), decodeValue(e.Normals[1])}
+}
+
+type EdgeData struct {
+	Segments    [][2]uint32
+	Silhouettes []SilhouetteEdge
+	Polylines   [][]uint32
+}
+
+func (d *EdgeData) IsEmpty() bool {
+	return len(d.Segments) == 0 && len(d.Silhouettes) == 0 && len(d.Polylines) == 0
+}
+
+var segmentQuadIndices = [6]uint8{0, 2, 1, 1, 2, 3}
+
+func segmentEndPoints(p0 uint32, p1 uint32, i int) (uint32, uint32) {
+	if segmentQuadIndices[i] == 2 || segmentQuadIndices[i] == 3 {
+		return p1, p0
+	}
+	return p0, p1
+}
+
+/**
+ *  Each segment edge is drawn as a quad of 6 vertices. Each vertex has a
+ *  24-bit vertex index, plus 4 bytes of endPointAndQuadIndex:
+ *  endPoint        00
+ *  quadIndex       03
+ */
+func EncodeSegmentEdges(segments [][2]uint32) ([]byte, []byte) {
+	indices := make([]byte, len(segments)*6*3)
+	endPointAndQuadIndices := make([]byte, len(segments)*6*4)
+	for i := range segments {
+		for j := 0; j < 6; j++ {
+			k := i*6 + j
+			p0, p1 := segmentEndPoints(segments[i][0], segments[i][1], j)
+			encodeIndex(p0, indices, k*3)
+			encodeIndex(p1, endPointAndQuadIndices, k*4)
+			endPointAndQuadIndices[k*4+3] = segmentQuadIndices[j]
+		}
+	}
+	return indices, endPointAndQuadIndices
+}
+
+func DecodeSegmentEdges(indices []byte, endPointAndQuadIndices []byte) [][2]uint32 {
+	count := len(indices) / (6 * 3)
+	if len(endPointAndQuadIndices) < count*6*4 {
+		count = len(endPointAndQuadIndices) / (6 * 4)
+	}
+	segments := make([][2]uint32, count)
+	for i := range segments {
+		segments[i][0] = decodeIndex(i*6, indices)
+		segments[i][1] = decodeIndexAt(endPointAndQuadIndices, i*6*4)
+	}
+	return segments
+}
+
+func EncodeSilhouetteEdges(silhouettes []SilhouetteEdge) ([]byte, []byte, []byte) {
+	segments := make([][2]uint32, len(silhouettes))
+	normalPairs := make([]byte, len(silhouettes)*6*4)
+	for i := range silhouettes {
+		segments[i] = silhouettes[i].Indices
+		for j := 0; j < 6; j++ {
+			k := (i*6 + j) * 4
+			normalPairs[k+0] = byte(silhouettes[i].Normals[0] & 0x00ff)
+			normalPairs[k+1] = byte(silhouettes[i].Normals[0] >> 8)
+			normalPairs[k+2] = byte(silhouettes[i].Normals[1] & 0x00ff)
+			normalPairs[k+3] = byte(silhouettes[i].Normals[1] >> 8)
+		}
+	}
+	indices, endPointAndQuadIndices := EncodeSegmentEdges(segments)
+	return indices, endPointAndQuadIndices, normalPairs
+}
+
+func DecodeSilhouetteEdges(indices []byte, endPointAndQuadIndices []byte, normalPairs []byte) []SilhouetteEdge {
+	segments := DecodeSegmentEdges(indices, endPointAndQuadIndices)
+	silhouettes := make([]SilhouetteEdge, len(segments))
+	for i := range segments {
+		silhouettes[i].Indices = segments[i]
+		k := i * 6 * 4
+		if k+4 <= len(normalPairs) {
+			silhouettes[i].Normals[0] = uint16(normalPairs[k]) | uint16(normalPairs[k+1])<<8
+			silhouettes[i].Normals[1] = uint16(normalPairs[k+2]) | uint16(normalPairs[k+3])<<8
+		}
+	}
+	return silhouettes
+}
+
+func (e *MeshEdges) decodeData(chunkMap map[string]*chunkData) *EdgeData {
+	data := &EdgeData{}
+	if e.Segments != nil {
+		indices, ok1 := chunkMap[e.Segments.Indices]
+		endPoints, ok2 := chunkMap[e.Segments.EndPointAndQuadIndices]
+		if ok1 && ok2 {
+			data.Segments = DecodeSegmentEdges(indices.data, endPoints.data)
+		}
+	}
+	if e.Silhouettes != nil {
+		indices, ok1 := chunkMap[e.Silhouettes.Indices]
+		endPoints, ok2 := chunkMap[e.Silhouettes.EndPointAndQuadIndices]
+		normalPairs, ok3 := chunkMap[e.Silhouettes.NormalPairs]
+		if ok1 && ok2 && ok3 {
+			data.Silhouettes = DecodeSilhouetteEdges(indices.data, endPoints.data, normalPairs.data)
+		}
+	}
+	if e.Polylines != nil {
+		indices, ok1 := chunkMap[e.Polylines.Indices]
+		prevIndices, ok2 := chunkMap[e.Polylines.PrevIndices]
+		nextIndicesAndParams, ok3 := chunkMap[e.Polylines.NextIndicesAndParams]
+		if ok1 && ok2 && ok3 {
+			tp := &TesselatedPolyline{}
+			tp.Decode(indices.data, prevIndices.data, nextIndicesAndParams.data)
+			data.Polylines = tp.Lines()
+		}
+	}
+	return data
+}
+
+func (e *MeshEdges) encodeData(data *EdgeData, nextBufferName func() string) []chunkData {
+	var chunks []chunkData
+
+	if len(data.Segments) > 0 {
+		if e.Segments == nil {
+			e.Segments = &SegmentEdges{}
+		}
+		if e.Segments.Indices == "" {
+			e.Segments.Indices = nextBufferName()
+		}
+		if e.Segments.EndPointAndQuadIndices == "" {
+			e.Segments.EndPointAndQuadIndices = nextBufferName()
+		}
+		indices, endPoints := EncodeSegmentEdges(data.Segments)
+		chunks = append(chunks, chunkData{name: e.Segments.Indices, data: indices})
+		chunks = append(chunks, chunkData{name: e.Segments.EndPointAndQuadIndices, data: endPoints})
+	} else {
+		e.Segments = nil
+	}
+
+	if len(data.Silhouettes) > 0 {
+		if e.Silhouettes == nil {
+			e.Silhouettes = &SilhouetteEdges{}
+		}
+		if e.Silhouettes.Indices == "" {
+			e.Silhouettes.Indices = nextBufferName()
+		}
+		if e.Silhouettes.EndPointAndQuadIndices == "" {
+			e.Silhouettes.EndPointAndQuadIndices = nextBufferName()
+		}
+		if e.Silhouettes.NormalPairs == "" {
+			e.Silhouettes.NormalPairs = nextBufferName()
+		}
+		indices, endPoints, normalPairs := EncodeSilhouetteEdges(data.Silhouettes)
+		chunks = append(chunks, chunkData{name: e.Silhouettes.Indices, data: indices})
+		chunks = append(chunks, chunkData{name: e.Silhouettes.EndPointAndQuadIndices, data: endPoints})
+		chunks = append(chunks, chunkData{name: e.Silhouettes.NormalPairs, data: normalPairs})
+	} else {
+		e.Silhouettes = nil
+	}
+
+	if len(data.Polylines) > 0 {
+		if e.Polylines == nil {
+			e.Polylines = &Polyline{}
+		}
+		if e.Polylines.Indices == "" {
+			e.Polylines.Indices = nextBufferName()
+		}
+		if e.Polylines.PrevIndices == "" {
+			e.Polylines.PrevIndices = nextBufferName()
+		}
+		if e.Polylines.NextIndicesAndParams == "" {
+			e.Polylines.NextIndicesAndParams = nextBufferName()
+		}
+		tp := TesselatePolylines(data.Polylines)
+		chunks = append(chunks, chunkData{name: e.Polylines.Indices, data: tp.EncodeIndices()})
+		chunks = append(chunks, chunkData{name: e.Polylines.PrevIndices, data: tp.EncodePrevIndices()})
+		chunks = append(chunks, chunkData{name: e.Polylines.NextIndicesAndParams, data: tp.EncodeNextIndicesAndParams()})
+	} else {
+		e.Polylines = nil
+	}
+
+	return chunks
+}
+
+type edgeFace struct {
+	normal vec3
+	p0, p1 uint32
+}
+
+// GenerateEdges finds the boundary edges and the edges whose adjacent faces
+// meet at more than creaseAngle radians, and returns them as segments. Edges
+// between two faces at a smaller, non-zero angle become silhouettes carrying
+// both face normals. Vertices are matched by position so that split normals
+// or uvs do not produce spurious boundaries.
+func (d *MeshData) GenerateEdges(creaseAngle float64) *EdgeData {
+	ids := make(map[[3]float32]uint32)
+	posIds := make([]uint32, len(d.Vertexs))
+	for i := range d.Vertexs {
+		id, ok := ids[d.Vertexs[i].Pos]
+		if !ok {
+			id = uint32(len(ids))
+			ids[d.Vertexs[i].Pos] = id
+		}
+		posIds[i] = id
+	}
+
+	var keys [][2]uint32
+	faces := make(map[[2]uint32][]edgeFace)
+	for t := 0; t+2 < len(d.Indices); t += 3 {
+		tri := d.Indices[t : t+3]
+		p0, p1, p2 := toVec3(d.Vertexs[tri[0]].Pos), toVec3(d.Vertexs[tri[1]].Pos), toVec3(d.Vertexs[tri[2]].Pos)
+		normal := p1.sub(p0).cross(p2.sub(p0))
+		area := normal.length()
+		if area == 0 {
+			continue
+		}
+		normal = normal.scale(1 / area)
+
+		for j := 0; j < 3; j++ {
+			a, b := tri[j], tri[(j+1)%3]
+			key := [2]uint32{posIds[a], posIds[b]}
+			if key[0] == key[1] {
+				continue
+			}
+			if key[0] > key[1] {
+				key[0], key[1] = key[1], key[0]
+			}
+			if _, ok := faces[key]; !ok {
+				keys = append(keys, key)
+			}
+			faces[key] = append(faces[key], edgeFace{normal: normal, p0: a, p1: b})
+		}
+	}
+
+	minDot := math.Cos(creaseAngle)
+	const coplanarDot = 1 - 1e-6
+
+	edges := &EdgeData{}
+	for _, key := range keys {
+		adjacent := faces[key]
+		f := adjacent[0]
+		if len(adjacent) != 2 {
+			edges.Segments = append(edges.Segments, [2]uint32{f.p0, f.p1})
+			continue
+		}
+
+		dot := f.normal.dot(adjacent[1].normal)
+		switch {
+		case dot < minDot:
+			edges.Segments = append(edges.Segments, [2]uint32{f.p0, f.p1})
+		case dot < coplanarDot:
+			n0, n1 := f.normal, adjacent[1].normal
+			edges.Silhouettes = append(edges.Silhouettes, SilhouetteEdge{
+				Indices: [2]uint32{f.p0, f.p1},
+				Normals: [2]uint16{
+					encodeXYZ(float32(n0[0]), float32(n0[1]), float32(n0[2])),
+					encodeXYZ(float32(n1[0]), float32(n1[1]), float32(n1[2])),
+				},
+			})
+		}
+	}
+	return edges
+}
+
+// GenerateEdges computes edges for every mesh primitive that has none; they
+// are written as segments and silhouettes when the document is encoded. It
+// returns the number of primitives that received edges.
+func (doc *Document) GenerateEdges(creaseAngle float64) int {
+	count := 0
+	for _, k := range sortedKeys(doc.Meshes) {
+		for _, item := range doc.Meshes[k].Primitives {
+			p, ok := item.(*MeshPrimitive)
+			if !ok || p.Data == nil || p.Edges != nil || p.EdgeData != nil {
+				continue
+			}
+			if edges := p.Data.GenerateEdges(creaseAngle); !edges.IsEmpty() {
+				p.EdgeData = edges
+				count++
+			}
+		}
+	}
+	return count
+}
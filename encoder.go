@@ -3,6 +3,7 @@ package imdl
 import (
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 )
@@ -31,7 +32,14 @@ func saveImdl(doc *Document, name string, asBinary bool) error {
 
 type Encoder struct {
 	AsBinary bool
-	w        io.Writer
+	// Passthrough keeps the decoded buffers and quantization params of
+	// primitives whose data has not been modified since decoding with
+	// Decoder.Passthrough or the last passthrough encoding.
+	Passthrough bool
+	// CompactVertices welds duplicate vertices and drops unused ones before
+	// the buffers are written.
+	CompactVertices bool
+	w               io.Writer
 }
 
 func NewEncoder(w io.Writer) *Encoder {
@@ -43,6 +51,7 @@ func NewEncoder(w io.Writer) *Encoder {
 
 func (e *Encoder) Encode(doc *Document) error {
 	var err error
+	e.prepare(doc, e.AsBinary)
 	if e.AsBinary {
 		err = e.encodeBinary(doc)
 	} else {
@@ -55,38 +64,68 @@ func (e *Encoder) Encode(doc *Document) error {
 	return nil
 }
 
-func (e *Encoder) encodeBinary(doc *Document) error {
-	chunks, si := doc.encodeChunkData()
+func (e *Encoder) prepare(doc *Document, asBinary bool) {
+	if e.CompactVertices {
+		doc.CompactVertices()
+	}
+	doc.updateExtensionsUsed(asBinary)
+}
+
+// glbLayout is everything written ahead of the binary chunks, computed
+// before anything is written so the total length is known up front.
+type glbLayout struct {
+	header   glbHeader
+	jsonText []byte
+	padding  []byte
+}
+
+func (e *Encoder) layoutBinary(doc *Document) (*glbLayout, error) {
+	si, err := doc.encodeChunkData(e.Passthrough)
+	if err != nil {
+		return nil, err
+	}
 
 	jsonText, err := json.Marshal(doc)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	jsonHeader := JSONHeader{
 		Length: uint32(((len(jsonText) + 3) / 4) * 4),
 		Type:   0,
 	}
-	header := glbHeader{
-		Magic:      glbHeaderMagic,
-		Version:    1,
-		Length:     12 + 8 + jsonHeader.Length + si,
-		JSONHeader: jsonHeader,
+	l := &glbLayout{
+		header: glbHeader{
+			Magic:      glbHeaderMagic,
+			Version:    1,
+			Length:     12 + 8 + jsonHeader.Length + si,
+			JSONHeader: jsonHeader,
+		},
+		jsonText: jsonText,
+		padding:  make([]byte, jsonHeader.Length-uint32(len(jsonText))),
+	}
+	for i := range l.padding {
+		l.padding[i] = ' '
 	}
-	headerPadding := make([]byte, header.JSONHeader.Length-uint32(len(jsonText)))
-	for i := range headerPadding {
-		headerPadding[i] = ' '
+	return l, nil
+}
+
+func (e *Encoder) writeBinary(doc *Document, l *glbLayout) error {
+	if err := binary.Write(e.w, binary.LittleEndian, &l.header); err != nil {
+		return fmt.Errorf("imdl: writing GLB header: %w", err)
+	}
+	if _, err := e.w.Write(l.jsonText); err != nil {
+		return fmt.Errorf("imdl: writing GLB JSON: %w", err)
 	}
+	if _, err := e.w.Write(l.padding); err != nil {
+		return fmt.Errorf("imdl: writing GLB JSON: %w", err)
+	}
+	return doc.writeChunks(e.w)
+}
 
-	err = binary.Write(e.w, binary.LittleEndian, &header)
+func (e *Encoder) encodeBinary(doc *Document) error {
+	l, err := e.layoutBinary(doc)
 	if err != nil {
 		return err
 	}
-	e.w.Write(jsonText)
-	e.w.Write(headerPadding)
-
-	for i := range chunks {
-		e.w.Write(chunks[i])
-	}
-
-	return nil
+	return e.writeBinary(doc, l)
 }
@@ -1,9 +1,39 @@
 package imdl
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/flywave/gltf"
 )
 
+var errWriteLimit = errors.New("write limit reached")
+
+type limitedWriter struct {
+	n int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		w.n = 0
+		return 0, errWriteLimit
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
 func TestEncode(t *testing.T) {
 	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
 	if err != nil || doc == nil {
@@ -11,3 +41,1039 @@ func TestEncode(t *testing.T) {
 	}
 
 }
+
+func TestEncodeInstances(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-1-0-1-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).Encode(doc); err != nil {
+		t.FailNow()
+	}
+
+	odoc := &Document{}
+	if err := NewDecoder(buf).Decode(odoc); err != nil {
+		t.FailNow()
+	}
+
+	privs := doc.Meshes["Mesh_Root"].Primitives
+	oprivs := odoc.Meshes["Mesh_Root"].Primitives
+	for i := range privs {
+		if privs[i].GetPrimitive().Instances == nil {
+			continue
+		}
+		if !reflect.DeepEqual(privs[i].GetPrimitive().Instances.Data, oprivs[i].GetPrimitive().Instances.Data) {
+			t.FailNow()
+		}
+	}
+}
+
+func TestEncodeEdges(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	prim := doc.Meshes[MESH_ROOT].Primitives[0].(*MeshPrimitive)
+	prim.EdgeData = &EdgeData{
+		Segments:  [][2]uint32{{0, 1}, {1, 2}, {2, 0}},
+		Polylines: [][]uint32{{3, 4, 5}},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).Encode(doc); err != nil {
+		t.FailNow()
+	}
+
+	odoc := &Document{}
+	if err := NewDecoder(buf).Decode(odoc); err != nil {
+		t.FailNow()
+	}
+
+	oprim := odoc.Meshes[MESH_ROOT].Primitives[0].(*MeshPrimitive)
+	if oprim.Edges == nil || oprim.Edges.Silhouettes != nil || !reflect.DeepEqual(prim.EdgeData, oprim.EdgeData) {
+		t.FailNow()
+	}
+}
+
+func TestEncodePolylineParams(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	tp := &TesselatedPolyline{}
+	tp.Decode(doc.FindBuffer("bvindices25"), doc.FindBuffer("bvprevIndices25"), doc.FindBuffer("bvnextIndicesAndParams25"))
+
+	line, ok := doc.Meshes["Mesh_Root"].Primitives[25].(*PolylinePrimitive)
+	if !ok || !reflect.DeepEqual(line.Data.GetTesselation(), tp) {
+		t.FailNow()
+	}
+
+	line.Vertices.BufferView = ""
+	line.Indices = ""
+	line.PrevIndices = ""
+	line.NextIndicesAndParams = ""
+
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).Encode(doc); err != nil {
+		t.FailNow()
+	}
+
+	odoc := &Document{}
+	if err := NewDecoder(buf).Decode(odoc); err != nil {
+		t.FailNow()
+	}
+
+	oline, ok := odoc.Meshes["Mesh_Root"].Primitives[25].(*PolylinePrimitive)
+	if !ok || !oline.Data.HasPolylineParams() || !reflect.DeepEqual(oline.Data.GetTesselation(), tp) {
+		t.FailNow()
+	}
+
+	if len(oline.Data.Vertexs) != len(line.Data.Vertexs) || oline.Data.Vertexs[3].QPos != line.Data.Vertexs[3].QPos {
+		t.FailNow()
+	}
+}
+
+func TestEncodeMaterialAtlas(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).Encode(doc); err != nil {
+		t.FailNow()
+	}
+
+	odoc := &Document{}
+	if err := NewDecoder(buf).Decode(odoc); err != nil {
+		t.FailNow()
+	}
+
+	prim := doc.Meshes["Mesh_Root"].Primitives[1].(*MeshPrimitive)
+	oprim := odoc.Meshes["Mesh_Root"].Primitives[1].(*MeshPrimitive)
+	if !reflect.DeepEqual(prim.Data.Materials, oprim.Data.Materials) || !reflect.DeepEqual(prim.Vertices.ColorTable, oprim.Vertices.ColorTable) {
+		t.FailNow()
+	}
+
+	for i := range prim.Data.Vertexs {
+		if *prim.Data.Vertexs[i].MaterialIndex != *oprim.Data.Vertexs[i].MaterialIndex || *prim.Data.Vertexs[i].FeatureIndex != *oprim.Data.Vertexs[i].FeatureIndex {
+			t.FailNow()
+		}
+	}
+}
+
+func TestEncodeTile(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	tile := &Tile{
+		Version:             0x00020001,
+		Flags:               IF_ContainsCurves | IF_Incomplete,
+		ContentRange:        [2][3]float64{{-1, -2, -3}, {4, 5, 6}},
+		Tolerance:           0.125,
+		NumElementsIncluded: 7,
+		NumElementsExcluded: 2,
+		EmptySubRanges:      0x10,
+		FeatureTable: FeatureTable{
+			MaxFeatures: 10,
+			Features: []Feature{
+				{ElementId: 0x2000000001a, SubCategoryId: 0x18, GeometryClass: GC_Primary},
+				{ElementId: 0x2000000001b, SubCategoryId: 0x20000000019, GeometryClass: GC_Pattern},
+				{ElementId: 0x1c, SubCategoryId: 0x18, GeometryClass: GC_Construction},
+			},
+		},
+		Document: doc,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).EncodeTile(tile); err != nil {
+		t.FailNow()
+	}
+
+	// The ImdlHeader of iTwin: magic, version, headerLength, flags,
+	// contentRange, tolerance, numElementsIncluded, numElementsExcluded,
+	// tileLength and, from major version 2 on, emptySubRanges.
+	data := buf.Bytes()
+	header, _ := hex.DecodeString("694d646c" + "01000200" + "58000000" + "05000000" +
+		"000000000000f0bf" + "00000000000000c0" + "00000000000008c0" +
+		"0000000000001040" + "0000000000001440" + "0000000000001840" +
+		"000000000000c03f" + "07000000" + "02000000" + "00000000" + "10000000")
+	binary.LittleEndian.PutUint32(header[80:], uint32(len(data)))
+	if !bytes.Equal(data[:len(header)], header) {
+		t.FailNow()
+	}
+
+	otile := &Tile{}
+	if err := NewDecoder(buf).DecodeTile(otile); err != nil {
+		t.FailNow()
+	}
+
+	if otile.Version != tile.Version || otile.Flags != tile.Flags || otile.ContentRange != tile.ContentRange || otile.Tolerance != tile.Tolerance || otile.EmptySubRanges != tile.EmptySubRanges || otile.NumElementsIncluded != 7 || otile.NumElementsExcluded != 2 {
+		t.FailNow()
+	}
+
+	if !otile.HasFlag(IF_Incomplete) || otile.HasFlag(IF_DisallowMagnification) || !reflect.DeepEqual(otile.FeatureTable, tile.FeatureTable) {
+		t.FailNow()
+	}
+
+	if otile.Document == nil || len(otile.Document.Meshes["Mesh_Root"].Primitives) != len(doc.Meshes["Mesh_Root"].Primitives) {
+		t.FailNow()
+	}
+
+	// Before major version 2 the header ends at tileLength.
+	tile.Version = 0x00010000
+	buf.Reset()
+	if err := NewEncoder(buf).EncodeTile(tile); err != nil {
+		t.FailNow()
+	}
+	data = buf.Bytes()
+	if binary.LittleEndian.Uint32(data[8:]) != 84 || int(binary.LittleEndian.Uint32(data[80:])) != len(data) {
+		t.FailNow()
+	}
+	otile = &Tile{}
+	if err := NewDecoder(buf).DecodeTile(otile); err != nil || otile.EmptySubRanges != 0 || otile.NumElementsExcluded != 2 || !reflect.DeepEqual(otile.FeatureTable, tile.FeatureTable) {
+		t.FailNow()
+	}
+}
+
+func TestEncodeExtensionsUsed(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	if !reflect.DeepEqual(doc.ExtensionsUsed, []string{"KHR_binary_glTF", "WEB3D_quantized_attributes"}) || !reflect.DeepEqual(doc.GlExtensionsUsed, []string{"OES_element_index_uint"}) {
+		t.FailNow()
+	}
+
+	doc.Members = Members{"copyright": json.RawMessage(`"test"`)}
+
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).Encode(doc); err != nil {
+		t.FailNow()
+	}
+
+	odoc := &Document{}
+	if err := NewDecoder(buf).Decode(odoc); err != nil {
+		t.FailNow()
+	}
+
+	if !reflect.DeepEqual(odoc.ExtensionsUsed, doc.ExtensionsUsed) || string(odoc.Members["copyright"]) != `"test"` {
+		t.FailNow()
+	}
+
+	ndoc := NewDocument()
+	buf.Reset()
+	if err := NewEncoder(buf).Encode(ndoc); err != nil {
+		t.FailNow()
+	}
+
+	if !reflect.DeepEqual(ndoc.ExtensionsUsed, []string{"KHR_binary_glTF", "WEB3D_quantized_attributes"}) || !reflect.DeepEqual(ndoc.GlExtensionsUsed, []string{"OES_element_index_uint"}) {
+		t.FailNow()
+	}
+
+	buf.Reset()
+	enc := NewEncoder(buf)
+	enc.AsBinary = false
+	if err := enc.Encode(doc); err != nil {
+		t.FailNow()
+	}
+	if !reflect.DeepEqual(doc.ExtensionsUsed, []string{"WEB3D_quantized_attributes"}) || strings.Contains(buf.String(), "KHR_binary_glTF") {
+		t.FailNow()
+	}
+}
+
+func TestEncodeVertexTable(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	var tables []VertexTable
+	for _, item := range doc.Meshes["Mesh_Root"].Primitives {
+		tables = append(tables, item.GetPrimitive().Vertices)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).Encode(doc); err != nil {
+		t.FailNow()
+	}
+
+	for i, item := range doc.Meshes["Mesh_Root"].Primitives {
+		v := item.GetPrimitive().Vertices
+		if v.Width != tables[i].Width || v.Height != tables[i].Height || v.Count != tables[i].Count || v.NumRgbaPerVertex != tables[i].NumRgbaPerVertex {
+			t.FailNow()
+		}
+		if len(v.Params.DecodeMatrix) != 16 || v.Params.DecodeMatrix[15] != 1 || v.Params.DecodeMatrix[12] != v.Params.DecodedMin[0] {
+			t.FailNow()
+		}
+		if int(doc.BufferViews[v.BufferView].ByteLength) != int(v.Width*v.Height*4) {
+			t.FailNow()
+		}
+	}
+
+	ndoc := NewDocument()
+	fid := uint32(0)
+	vertexs := make([]MeshVertex, 4)
+	for i := range vertexs {
+		vertexs[i].Pos = [3]float32{float32(i & 1), float32(i >> 1), 0}
+		vertexs[i].UV = &[2]float32{float32(i & 1), float32(i >> 1)}
+		vertexs[i].FeatureIndex = &fid
+	}
+	prim := &MeshPrimitive{Type: PT_Mesh, Surface: Surface{Type: ST_Textured}}
+	prim.Data = &MeshData{Type: ST_Textured, Indices: []uint32{0, 1, 2, 2, 1, 3}, Vertexs: vertexs}
+	ndoc.Meshes = map[string]*Mesh{"Mesh_Root": {Primitives: []PrimitiveItem{prim}}}
+
+	buf.Reset()
+	if err := NewEncoder(buf).Encode(ndoc); err != nil {
+		t.FailNow()
+	}
+
+	odoc := &Document{}
+	if err := NewDecoder(buf).Decode(odoc); err != nil {
+		t.FailNow()
+	}
+
+	oprim := odoc.Meshes[MESH_ROOT].Primitives[0].(*MeshPrimitive)
+	if oprim.Vertices.Count != 4 || oprim.Vertices.NumRgbaPerVertex != 4 || oprim.Vertices.Width != 16 || oprim.Vertices.Height != 1 || oprim.Surface.UVParams == nil {
+		t.FailNow()
+	}
+
+	if oprim.Data.Vertexs[3].Pos != vertexs[3].Pos || *oprim.Data.Vertexs[3].UV != *vertexs[3].UV {
+		t.FailNow()
+	}
+}
+
+func TestEncodeDeterministic(t *testing.T) {
+	var outputs [][]byte
+	for i := 0; i < 2; i++ {
+		doc, err := Open("./testdata/-3-1-1-0-1-1.gltf")
+		if err != nil || doc == nil {
+			t.FailNow()
+		}
+
+		for j := 0; j < 2; j++ {
+			buf := &bytes.Buffer{}
+			if err := NewEncoder(buf).Encode(doc); err != nil {
+				t.FailNow()
+			}
+			outputs = append(outputs, buf.Bytes())
+		}
+	}
+
+	for i := 1; i < len(outputs); i++ {
+		if !bytes.Equal(outputs[0], outputs[i]) {
+			t.FailNow()
+		}
+	}
+
+	odoc := &Document{}
+	if err := NewDecoder(bytes.NewReader(outputs[0])).Decode(odoc); err != nil {
+		t.FailNow()
+	}
+
+	if len(odoc.chunks) != len(odoc.BufferViews) {
+		t.FailNow()
+	}
+}
+
+func TestEncodePassthrough(t *testing.T) {
+	f, err := os.Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil {
+		t.FailNow()
+	}
+	defer f.Close()
+	doc := &Document{}
+	dec := NewDecoder(f)
+	dec.Passthrough = true
+	if err := dec.Decode(doc); err != nil {
+		t.FailNow()
+	}
+
+	src, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || src == nil {
+		t.FailNow()
+	}
+	// Digests are only recorded when decoding for passthrough.
+	for _, item := range src.Meshes["Mesh_Root"].Primitives {
+		if item.GetPrimitive().digest != nil {
+			t.FailNow()
+		}
+	}
+
+	prim := doc.Meshes["Mesh_Root"].Primitives[2].(*MeshPrimitive)
+	prim.Data.Vertexs[0].Pos[0] += 0.5
+	doc.Meshes["Mesh_Root"].Layer = "edited"
+
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	enc.Passthrough = true
+	if err := enc.Encode(doc); err != nil {
+		t.FailNow()
+	}
+
+	odoc := &Document{}
+	if err := NewDecoder(buf).Decode(odoc); err != nil || odoc.Meshes["Mesh_Root"].Layer != "edited" {
+		t.FailNow()
+	}
+
+	for i, item := range odoc.Meshes["Mesh_Root"].Primitives {
+		v := item.GetPrimitive().Vertices
+		sv := src.Meshes["Mesh_Root"].Primitives[i].GetPrimitive().Vertices
+		same := bytes.Equal(odoc.FindBuffer(v.BufferView), src.FindBuffer(sv.BufferView)) && reflect.DeepEqual(v.Params, sv.Params)
+		if same != (i != 2) {
+			t.FailNow()
+		}
+	}
+
+	oprim := odoc.Meshes["Mesh_Root"].Primitives[2].(*MeshPrimitive)
+	if math.Abs(float64(oprim.Data.Vertexs[0].Pos[0]-prim.Data.Vertexs[0].Pos[0])) > 1e-3 {
+		t.FailNow()
+	}
+}
+
+func TestEncodeVertexColors(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 128}
+
+	vertexs := make([]SimpleVertex, 3)
+	for i := range vertexs {
+		vertexs[i].Pos = [3]float32{float32(i), 0, 0}
+		vertexs[i].Color = &red
+	}
+	line := &PolylinePrimitive{Type: PT_Polyline, Data: &PolylineData{Indices: []uint32{0, 1, 2}, Vertexs: vertexs}}
+
+	doc := NewDocument()
+	doc.Meshes = map[string]*Mesh{"Mesh_Root": {Primitives: []PrimitiveItem{line}}}
+
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).Encode(doc); err != nil {
+		t.FailNow()
+	}
+
+	if line.Vertices.NumColors == nil || *line.Vertices.NumColors != 0 || line.Vertices.UniformColor != ColorToTbgr(red) || line.Vertices.HasTranslucency {
+		t.FailNow()
+	}
+
+	vertexs[1].Color = &blue
+	buf.Reset()
+	if err := NewEncoder(buf).Encode(doc); err != nil {
+		t.FailNow()
+	}
+
+	odoc := &Document{}
+	if err := NewDecoder(buf).Decode(odoc); err != nil {
+		t.FailNow()
+	}
+
+	oline := odoc.Meshes["Mesh_Root"].Primitives[0].(*PolylinePrimitive)
+	if *oline.Vertices.NumColors != 2 || !oline.Vertices.HasTranslucency {
+		t.FailNow()
+	}
+
+	table := oline.Vertices.ColorTable
+	for i, v := range oline.Data.Vertexs {
+		if table.GetColor(*v.ColorIndex) != *vertexs[i].Color {
+			t.FailNow()
+		}
+	}
+
+	// A primitive color applies to the vertices without a color of their own.
+	green := color.NRGBA{G: 255, A: 255}
+	points := &PointStringPrimitive{Type: PT_Point, Data: &PointStringData{Indices: []uint32{0, 1, 2}, Vertexs: make([]SimpleVertex, 3)}}
+	points.Vertices.SetColor(green)
+	doc.Meshes["Mesh_Root"].Primitives = []PrimitiveItem{points}
+	if err := NewEncoder(&bytes.Buffer{}).Encode(doc); err != nil {
+		t.FailNow()
+	}
+	if points.Vertices.UniformColor != ColorToTbgr(green) || *points.Vertices.NumColors != 0 {
+		t.FailNow()
+	}
+
+	points.Data.Vertexs[1].Color = &blue
+	if err := NewEncoder(&bytes.Buffer{}).Encode(doc); err != nil || *points.Vertices.NumColors != 2 {
+		t.FailNow()
+	}
+	if points.Vertices.ColorTable.GetColor(*points.Data.Vertexs[0].ColorIndex) != green {
+		t.FailNow()
+	}
+
+	// Color indices are 16 bits wide.
+	colors := make([]color.NRGBA, MaxColorTableSize+1)
+	for i := range colors {
+		colors[i] = color.NRGBA{R: uint8(i), G: uint8(i >> 8), B: uint8(i >> 16), A: 255}
+	}
+	if _, _, err := NewColorTable(colors[:MaxColorTableSize]); err != nil {
+		t.FailNow()
+	}
+	points.Data = &PointStringData{Indices: []uint32{0}, Vertexs: make([]SimpleVertex, len(colors))}
+	for i := range colors {
+		points.Data.Vertexs[i].Color = &colors[i]
+	}
+	if err := NewEncoder(&bytes.Buffer{}).Encode(doc); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestEncodePolylineLines(t *testing.T) {
+	vertexs := make([]SimpleVertex, 4)
+	for i := range vertexs {
+		vertexs[i].Pos = [3]float32{float32(i), float32(i % 2), 0}
+	}
+	lines := [][]uint32{{0, 1, 2, 3}}
+	line := &PolylinePrimitive{Type: PT_Polyline, Data: &PolylineData{Lines: lines, Vertexs: vertexs}}
+	line.Material = "wide"
+
+	width := uint32(4)
+	doc := NewDocument()
+	doc.Materials = map[string]*Material{"wide": {LineWidth: &width}}
+	doc.Meshes = map[string]*Mesh{"Mesh_Root": {Primitives: []PrimitiveItem{line}}}
+
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).Encode(doc); err != nil {
+		t.FailNow()
+	}
+	if line.PrevIndices == "" || line.NextIndicesAndParams == "" || line.Data.Lines != nil {
+		t.FailNow()
+	}
+
+	odoc := &Document{}
+	if err := NewDecoder(buf).Decode(odoc); err != nil {
+		t.FailNow()
+	}
+
+	oline := odoc.Meshes["Mesh_Root"].Primitives[0].(*PolylinePrimitive)
+	if !oline.Data.HasPolylineParams() || !reflect.DeepEqual(oline.Data.GetTesselation().Lines(), lines) {
+		t.FailNow()
+	}
+
+	joints := false
+	for _, p := range oline.Data.Params {
+		joints = joints || p.IsJoint()
+	}
+	if !joints {
+		t.FailNow()
+	}
+}
+
+func TestEncodeCompactVertices(t *testing.T) {
+	positions := [][3]float32{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {0, 0, 0}, {1, 1, 0}, {0, 1, 0}, {5, 5, 5}}
+	normal := [3]float32{0, 0, 1}
+	mesh := &MeshPrimitive{Type: PT_Mesh, Data: &MeshData{Type: ST_Unlit, Indices: []uint32{0, 1, 2, 3, 4, 5}}}
+	for _, p := range positions {
+		mesh.Data.Vertexs = append(mesh.Data.Vertexs, MeshVertex{SimpleVertex: SimpleVertex{Pos: p}, Normal: &normal})
+	}
+	mesh.EdgeData = &EdgeData{Segments: [][2]uint32{{0, 1}, {3, 5}}}
+
+	points := &PointStringPrimitive{Type: PT_Point, Data: &PointStringData{Indices: []uint32{0, 2, 0}, Vertexs: []SimpleVertex{{Pos: [3]float32{0, 0, 0}}, {Pos: [3]float32{1, 0, 0}}, {Pos: [3]float32{0, 0, 0}}}}}
+
+	doc := NewDocument()
+	doc.Meshes = map[string]*Mesh{"Mesh_Root": {Primitives: []PrimitiveItem{mesh, points}}}
+
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	enc.CompactVertices = true
+	if err := enc.Encode(doc); err != nil {
+		t.FailNow()
+	}
+
+	odoc := &Document{}
+	if err := NewDecoder(buf).Decode(odoc); err != nil {
+		t.FailNow()
+	}
+
+	omesh := odoc.Meshes[MESH_ROOT].Primitives[0].(*MeshPrimitive)
+	if len(omesh.Data.Vertexs) != 4 || !reflect.DeepEqual(omesh.Data.Indices, []uint32{0, 1, 2, 0, 2, 3}) {
+		t.FailNow()
+	}
+	if !reflect.DeepEqual(omesh.EdgeData.Segments, [][2]uint32{{0, 1}, {0, 3}}) {
+		t.FailNow()
+	}
+
+	opoints := odoc.Meshes["Mesh_Root"].Primitives[1].(*PointStringPrimitive)
+	if len(opoints.Data.Vertexs) != 1 || !reflect.DeepEqual(opoints.Data.Indices, []uint32{0, 0, 0}) {
+		t.FailNow()
+	}
+
+	if odoc.CompactVertices() != 0 {
+		t.FailNow()
+	}
+}
+
+func TestCompactInvalidIndices(t *testing.T) {
+	positions := [][3]float32{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {0, 1, 0}, {5, 5, 5}}
+
+	// A triangle with an index of no vertex is dropped whole.
+	mesh := &MeshData{Type: ST_Unlit, Indices: []uint32{0, 1, 2, 0, 7, 2, 1, 2, 3}}
+	for _, p := range positions {
+		mesh.Vertexs = append(mesh.Vertexs, MeshVertex{SimpleVertex: SimpleVertex{Pos: p}})
+	}
+	if mesh.Compact() == nil || len(mesh.Vertexs) != 4 || !reflect.DeepEqual(mesh.Indices, []uint32{0, 1, 2, 1, 2, 3}) {
+		t.FailNow()
+	}
+
+	var vertexs []SimpleVertex
+	for _, p := range positions {
+		vertexs = append(vertexs, SimpleVertex{Pos: p})
+	}
+
+	// Line strings are split around the missing vertex.
+	line := &PolylineData{Lines: [][]uint32{{0, 1, 9, 2, 3}}, Vertexs: append([]SimpleVertex(nil), vertexs...)}
+	if line.Compact() == nil || !reflect.DeepEqual(line.Lines, [][]uint32{{0, 1}, {2, 3}}) {
+		t.FailNow()
+	}
+
+	// Tesselated triangles are dropped from all the parallel arrays.
+	tesselated := &PolylineData{Lines: [][]uint32{{0, 1, 2, 3}}, Vertexs: append([]SimpleVertex(nil), vertexs...)}
+	tesselated.Tesselate(false)
+	n := len(tesselated.Indices)
+	tesselated.PrevIndices[4] = 9
+	if tesselated.Compact() == nil || !tesselated.HasPolylineParams() || len(tesselated.Indices) != n-3 {
+		t.FailNow()
+	}
+}
+
+func TestEncodeWriteErrors(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).Encode(doc); err != nil {
+		t.FailNow()
+	}
+
+	last := doc.chunks[len(doc.chunks)-1]
+	err = NewEncoder(&limitedWriter{n: buf.Len() - len(last.data)}).Encode(doc)
+	if !errors.Is(err, errWriteLimit) || !strings.Contains(err.Error(), last.name) {
+		t.FailNow()
+	}
+
+	err = NewEncoder(&limitedWriter{n: 4}).Encode(doc)
+	if !errors.Is(err, errWriteLimit) {
+		t.FailNow()
+	}
+
+	doc.NamedTextures = map[string]*RenderTexture{"tex": {BufferView: "bvtex", Format: 7, TextureData: image.NewNRGBA(image.Rect(0, 0, 2, 2))}}
+	err = NewEncoder(&bytes.Buffer{}).Encode(doc)
+	if err == nil || !strings.Contains(err.Error(), "bvtex") {
+		t.FailNow()
+	}
+}
+
+func TestExportGltf(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	out, err := ExportGltf(doc)
+	if err != nil || len(out.Meshes) != 2 || len(out.Textures) == 0 {
+		t.FailNow()
+	}
+
+	root := out.Meshes[*out.Nodes[1].Mesh]
+	if root.Name != "Mesh_Root" || len(root.Primitives) != 26 || root.Primitives[25].Mode != gltf.PrimitiveLines {
+		t.FailNow()
+	}
+	if _, ok := root.Primitives[0].Attributes[FeatureIdAttribute]; !ok {
+		t.FailNow()
+	}
+
+	var instanced *gltf.Node
+	for _, n := range out.Nodes {
+		if _, ok := n.Extensions[extMeshGpuInstancing]; ok {
+			instanced = n
+		}
+	}
+	if instanced == nil || out.Meshes[*instanced.Mesh].Primitives[0].Mode != gltf.PrimitiveTriangles {
+		t.FailNow()
+	}
+
+	buf := &bytes.Buffer{}
+	enc := gltf.NewEncoder(buf)
+	enc.AsBinary = true
+	if err := enc.Encode(out); err != nil {
+		t.FailNow()
+	}
+	odoc := &gltf.Document{}
+	if err := gltf.NewDecoder(buf).Decode(odoc); err != nil || len(odoc.Meshes) != 2 || len(odoc.Accessors) != len(out.Accessors) {
+		t.FailNow()
+	}
+}
+
+func TestExportObj(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	dir, err := ioutil.TempDir("", "imdl")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	if err := SaveObj(doc, filepath.Join(dir, "tile.obj")); err != nil {
+		t.FailNow()
+	}
+
+	obj, err := ioutil.ReadFile(filepath.Join(dir, "tile.obj"))
+	if err != nil {
+		t.FailNow()
+	}
+	counts := make(map[string]int)
+	for _, line := range strings.Split(string(obj), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			counts[fields[0]]++
+		}
+	}
+	if counts["mtllib"] != 1 || counts["g"] != 27 || counts["usemtl"] != 27 || counts["f"] == 0 || counts["vt"] == 0 || counts["l"] == 0 {
+		t.FailNow()
+	}
+
+	mtl, err := ioutil.ReadFile(filepath.Join(dir, "tile.mtl"))
+	if err != nil {
+		t.FailNow()
+	}
+	textures := 0
+	for _, line := range strings.Split(string(mtl), "\n") {
+		if strings.HasPrefix(line, "map_Kd ") {
+			if _, err := os.Stat(filepath.Join(dir, strings.TrimPrefix(line, "map_Kd "))); err != nil {
+				t.FailNow()
+			}
+			textures++
+		}
+	}
+	if textures == 0 {
+		t.FailNow()
+	}
+}
+
+func TestExportPly(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ExportPly(doc, buf); err != nil {
+		t.FailNow()
+	}
+	end := bytes.Index(buf.Bytes(), []byte("end_header\n"))
+	if end < 0 {
+		t.FailNow()
+	}
+	header := string(buf.Bytes()[:end])
+	if !strings.Contains(header, "format binary_little_endian 1.0\n") || !strings.Contains(header, "property int feature_id\n") || !strings.Contains(header, "element face 33621\n") {
+		t.FailNow()
+	}
+
+	mesh := doc.Meshes[MESH_ROOT].Primitives[0].(*MeshPrimitive)
+	var v plyVertex
+	if err := binary.Read(bytes.NewReader(buf.Bytes()[end+len("end_header\n"):]), binary.LittleEndian, &v); err != nil {
+		t.FailNow()
+	}
+	id, _ := mesh.Vertices.vertexFeatureId(&mesh.Data.Vertexs[0].SimpleVertex)
+	c := mesh.Vertices.vertexColor(&mesh.Data.Vertexs[0].SimpleVertex)
+	if v.Pos != mesh.Data.Vertexs[0].Pos || v.FeatureId != int32(id) || v.Color != [4]uint8{c.R, c.G, c.B, c.A} {
+		t.FailNow()
+	}
+}
+
+func TestExportStl(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	count := func(opts StlOptions) int {
+		buf := &bytes.Buffer{}
+		if err := ExportStl(doc, buf, opts); err != nil || buf.Len() < 84 {
+			t.FailNow()
+		}
+		n := int(binary.LittleEndian.Uint32(buf.Bytes()[80:]))
+		if buf.Len() != 84+50*n {
+			t.FailNow()
+		}
+		return n
+	}
+
+	all := count(StlOptions{})
+	if all != 33621 {
+		t.FailNow()
+	}
+	mesh := doc.Meshes[MESH_ROOT].Primitives[0].(*MeshPrimitive)
+	if n := count(StlOptions{Materials: []string{mesh.Material}}); n == 0 || n >= all {
+		t.FailNow()
+	}
+	id, _ := mesh.Vertices.vertexFeatureId(&mesh.Data.Vertexs[0].SimpleVertex)
+	if n := count(StlOptions{FeatureIds: []uint32{id}}); n == 0 || n >= all {
+		t.FailNow()
+	}
+	if n := count(StlOptions{FeatureIds: []uint32{math.MaxUint32}}); n != 0 {
+		t.FailNow()
+	}
+}
+
+func TestExportB3dm(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	var prim *MeshPrimitive
+	for _, item := range doc.Meshes[MESH_ROOT].Primitives {
+		if p, ok := item.(*MeshPrimitive); ok && p.Instances != nil {
+			prim = p
+		}
+	}
+	if prim == nil {
+		t.FailNow()
+	}
+	channels := NewAuxChannels()
+	channels.Params["stress"] = []AuxScalarInput{{Input: 1, Values: make([]float32, len(prim.Data.Vertexs))}}
+	prim.AuxChannels = &AuxChannelTable{Channels: channels}
+	meshData, edgeData := prim.Data, prim.EdgeData
+
+	buf := &bytes.Buffer{}
+	if err := ExportB3dm(doc, buf); err != nil {
+		t.FailNow()
+	}
+
+	// The document is left as it was.
+	if prim.Instances == nil || prim.Data != meshData || prim.EdgeData != edgeData || prim.AuxChannels.Channels != channels {
+		t.FailNow()
+	}
+	if len(channels.Params["stress"][0].Values) != len(meshData.Vertexs) {
+		t.FailNow()
+	}
+	data := buf.Bytes()
+	var header b3dmHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &header); err != nil {
+		t.FailNow()
+	}
+	if string(header.Magic[:]) != "b3dm" || int(header.ByteLength) != len(data) {
+		t.FailNow()
+	}
+	ftStart := binary.Size(header)
+	btStart := ftStart + int(header.FeatureTableJSONByteLength)
+	glbStart := btStart + int(header.BatchTableJSONByteLength)
+	if btStart%8 != 0 || glbStart%8 != 0 {
+		t.FailNow()
+	}
+
+	var ft b3dmFeatureTable
+	var bt B3dmBatchTable
+	if json.Unmarshal(data[ftStart:btStart], &ft) != nil || json.Unmarshal(data[btStart:glbStart], &bt) != nil {
+		t.FailNow()
+	}
+	if ft.BatchLength == 0 || len(bt.CategoryId) != int(ft.BatchLength) || len(bt.MaterialId) != int(ft.BatchLength) {
+		t.FailNow()
+	}
+	mesh := doc.Meshes[MESH_ROOT].Primitives[0].(*MeshPrimitive)
+	id, _ := mesh.Vertices.vertexFeatureId(&mesh.Data.Vertexs[0].SimpleVertex)
+	if bt.CategoryId[id] != doc.Materials[mesh.Material].CategoryId || bt.MaterialId[id] != doc.Materials[mesh.Material].MaterialId {
+		t.FailNow()
+	}
+
+	out := &gltf.Document{}
+	if err := gltf.NewDecoder(bytes.NewReader(data[glbStart:])).Decode(out); err != nil {
+		t.FailNow()
+	}
+	for _, name := range out.ExtensionsUsed {
+		if name == extMeshGpuInstancing {
+			t.FailNow()
+		}
+	}
+	for _, m := range out.Meshes {
+		for _, p := range m.Primitives {
+			if _, ok := p.Attributes[BatchIdAttribute]; !ok {
+				t.FailNow()
+			}
+		}
+	}
+	// The root node moves the RTC center back to the origin.
+	m := out.Nodes[0].Matrix
+	if math.Abs(float64(m[12])+ft.RtcCenter[0]) > 1e-3 || math.Abs(float64(m[14])-ft.RtcCenter[1]) > 1e-3 {
+		t.FailNow()
+	}
+
+	// Instances are only expanded in the exported copy.
+	instanced := 0
+	for _, item := range doc.Meshes[MESH_ROOT].Primitives {
+		if item.GetPrimitive().Instances != nil {
+			instanced++
+		}
+	}
+	if instanced != 1 {
+		t.FailNow()
+	}
+
+	if err := ExportB3dm(doc, &limitedWriter{n: len(data) - 1}); !errors.Is(err, errWriteLimit) {
+		t.FailNow()
+	}
+}
+
+func TestMatrixToTRS(t *testing.T) {
+	m := [12]float32{0, -2, 0, 1, 2, 0, 0, 2, 0, 0, 2, 3}
+	tr, r, s := matrixToTRS(&m)
+	if tr != [3]float32{1, 2, 3} || s != [3]float32{2, 2, 2} {
+		t.FailNow()
+	}
+	h := float32(math.Sqrt(0.5))
+	if math.Abs(float64(r[2]-h)) > 1e-6 || math.Abs(float64(r[3]-h)) > 1e-6 || r[0] != 0 || r[1] != 0 {
+		t.FailNow()
+	}
+}
+
+func TestFlattenInstances(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-1-0-1-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	src, err := Open("./testdata/-3-1-1-0-1-1.gltf")
+	if err != nil || src == nil {
+		t.FailNow()
+	}
+
+	if doc.FlattenInstances() == 0 {
+		t.FailNow()
+	}
+
+	for i, item := range src.Meshes["Mesh_Root"].Primitives {
+		sp, ok := item.(*MeshPrimitive)
+		if !ok || sp.Instances == nil {
+			continue
+		}
+		p := doc.Meshes["Mesh_Root"].Primitives[i].(*MeshPrimitive)
+		inst := sp.Instances.Data
+		n := len(sp.Data.Vertexs)
+		if p.Instances != nil || len(p.Data.Vertexs) != n*inst.Count() || len(p.Data.Indices) != len(sp.Data.Indices)*inst.Count() {
+			t.FailNow()
+		}
+
+		center := sp.Instances.GetTransformCenter()
+		for k := 0; k < inst.Count(); k++ {
+			v := p.Data.Vertexs[k*n+n-1]
+			if v.Pos != inst.TransformPoint(k, center, sp.Data.Vertexs[n-1].Pos) || *v.FeatureIndex != inst.FeatureIds[k] {
+				t.FailNow()
+			}
+			if k < len(inst.SymbologyOverrides) && inst.SymbologyOverrides[k].HasFlag(IO_Rgb) {
+				o := inst.SymbologyOverrides[k].Color
+				if v.Color == nil || v.Color.R != o.R || v.Color.G != o.G || v.Color.B != o.B {
+					t.FailNow()
+				}
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).Encode(doc); err != nil {
+		t.FailNow()
+	}
+
+	odoc := &Document{}
+	if err := NewDecoder(buf).Decode(odoc); err != nil {
+		t.FailNow()
+	}
+
+	for _, item := range odoc.Meshes["Mesh_Root"].Primitives {
+		if item.GetPrimitive().Instances != nil {
+			t.FailNow()
+		}
+	}
+
+	for _, item := range src.Meshes["Mesh_Root"].Primitives {
+		if inst := item.GetPrimitive().Instances; inst != nil {
+			for _, name := range []string{inst.FeatureIds, inst.Transforms, inst.SymbologyOverrides} {
+				if _, ok := odoc.BufferViews[name]; ok && name != "" {
+					t.FailNow()
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeAreaPattern(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-0-0-0-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+
+	// Area patterns are never re-encoded, their offsets are carried over as
+	// decoded.
+	offsets := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	doc.chunks = append(doc.chunks, chunkData{name: "bvXYOffsets", data: offsets})
+	mesh := doc.Meshes[MESH_ROOT]
+	mesh.Primitives = append(mesh.Primitives, &AreaPattern{Type: "areaPattern", SymbolName: "symbol", XYOffsets: "bvXYOffsets"})
+
+	dir, err := ioutil.TempDir("", "imdl")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "pattern.imdl")
+
+	for i := 0; i < 2; i++ {
+		if err := SaveBinary(doc, name); err != nil {
+			t.FailNow()
+		}
+		doc, err = Open(name)
+		if err != nil || doc == nil {
+			t.FailNow()
+		}
+		if _, ok := doc.BufferViews["bvXYOffsets"]; !ok || !bytes.Equal(doc.FindBuffer("bvXYOffsets"), offsets) {
+			t.FailNow()
+		}
+		primitives := doc.Meshes[MESH_ROOT].Primitives
+		if p, ok := primitives[len(primitives)-1].(*AreaPattern); !ok || p.XYOffsets != "bvXYOffsets" {
+			t.FailNow()
+		}
+	}
+}
+
+func TestEncodeRemovedPrimitives(t *testing.T) {
+	doc, err := Open("./testdata/-3-1-1-0-1-1.gltf")
+	if err != nil || doc == nil {
+		t.FailNow()
+	}
+	views := len(doc.BufferViews)
+
+	mesh := doc.Meshes["Mesh_Root"]
+	mesh.Primitives = mesh.Primitives[:1]
+
+	for _, passthrough := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		enc := NewEncoder(buf)
+		enc.Passthrough = passthrough
+		if err := enc.Encode(doc); err != nil {
+			t.FailNow()
+		}
+
+		odoc := &Document{}
+		if err := NewDecoder(buf).Decode(odoc); err != nil || len(odoc.BufferViews) >= views {
+			t.FailNow()
+		}
+
+		used := make(map[string]bool)
+		for _, name := range primitiveBufferViews(odoc.Meshes["Mesh_Root"].Primitives[0]) {
+			used[name] = true
+		}
+		for _, tex := range odoc.NamedTextures {
+			used[tex.BufferView] = true
+		}
+		for name := range odoc.BufferViews {
+			if !used[name] {
+				t.FailNow()
+			}
+		}
+	}
+}
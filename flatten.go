@@ -0,0 +1,336 @@
+package imdl
+
+import (
+	"image/color"
+	"math"
+)
+
+func normalizeVector(v [3]float32) [3]float32 {
+	l := float32(math.Sqrt(float64(v[0]*v[0] + v[1]*v[1] + v[2]*v[2])))
+	if l == 0 {
+		return v
+	}
+	return [3]float32{v[0] / l, v[1] / l, v[2] / l}
+}
+
+func offsetIndices(dst []uint32, src []uint32, offset uint32) []uint32 {
+	for _, i := range src {
+		dst = append(dst, i+offset)
+	}
+	return dst
+}
+
+// instanceExpander copies vertex attributes of one instance.
+type instanceExpander struct {
+	data   *InstanceData
+	center [3]float32
+	colors *ColorTable
+	// recolor is set when a symbology override changes rgb or alpha.
+	recolor bool
+}
+
+func newInstanceExpander(inst *Instances, colors *ColorTable) *instanceExpander {
+	e := &instanceExpander{data: inst.Data, center: inst.GetTransformCenter(), colors: colors}
+	for i := range inst.Data.SymbologyOverrides {
+		if inst.Data.SymbologyOverrides[i].HasFlag(IO_Rgb) || inst.Data.SymbologyOverrides[i].HasFlag(IO_Alpha) {
+			e.recolor = true
+		}
+	}
+	return e
+}
+
+func (e *instanceExpander) count() int {
+	return e.data.Count()
+}
+
+func (e *instanceExpander) vertex(index int, v SimpleVertex) SimpleVertex {
+	v.Pos = e.data.TransformPoint(index, e.center, v.Pos)
+
+	if index < len(e.data.FeatureIds) {
+		id := e.data.FeatureIds[index]
+		v.FeatureIndex = &id
+	}
+
+	if e.recolor {
+		var c color.NRGBA
+		switch {
+		case v.Color != nil:
+			c = *v.Color
+		case e.colors != nil && v.ColorIndex != nil:
+			c = e.colors.GetColor(*v.ColorIndex)
+		case e.colors != nil:
+			c = e.colors.GetColor(0)
+		default:
+			c = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+		}
+		if index < len(e.data.SymbologyOverrides) {
+			o := &e.data.SymbologyOverrides[index]
+			if o.HasFlag(IO_Rgb) {
+				c.R, c.G, c.B = o.Color.R, o.Color.G, o.Color.B
+			}
+			if o.HasFlag(IO_Alpha) {
+				c.A = o.Color.A
+			}
+		}
+		v.Color = &c
+	}
+	return v
+}
+
+func (e *instanceExpander) normal(index int, n [3]float32) [3]float32 {
+	return normalizeVector(e.data.TransformVector(index, n))
+}
+
+func (e *instanceExpander) octNormal(index int, n uint16) uint16 {
+	r := e.normal(index, decodeValue(n))
+	return encodeXYZ(r[0], r[1], r[2])
+}
+
+func (e *instanceExpander) updateVertexTable(v *VertexTable) {
+	if len(e.data.FeatureIds) > 0 {
+		v.FeatureIndexType = NonUniform
+		v.FeatureId = nil
+		if e.count() == 1 {
+			id := e.data.FeatureIds[0]
+			v.FeatureIndexType = Uniform
+			v.FeatureId = &id
+		}
+	}
+}
+
+func (e *instanceExpander) meshData(d *MeshData) *MeshData {
+	n := uint32(len(d.Vertexs))
+	out := &MeshData{Type: d.Type, Materials: d.Materials}
+	for k := 0; k < e.count(); k++ {
+		out.Indices = offsetIndices(out.Indices, d.Indices, uint32(k)*n)
+		for i := range d.Vertexs {
+			v := d.Vertexs[i]
+			v.SimpleVertex = e.vertex(k, v.SimpleVertex)
+			if v.Normal != nil {
+				normal := e.normal(k, *v.Normal)
+				v.Normal = &normal
+				v.OctEncodedNormal = nil
+			} else if v.OctEncodedNormal != nil {
+				normal := e.octNormal(k, *v.OctEncodedNormal)
+				v.OctEncodedNormal = &normal
+			}
+			out.Vertexs = append(out.Vertexs, v)
+		}
+	}
+	return out
+}
+
+func (e *instanceExpander) edgeData(d *EdgeData, vertexCount int) *EdgeData {
+	n := uint32(vertexCount)
+	out := &EdgeData{}
+	for k := 0; k < e.count(); k++ {
+		offset := uint32(k) * n
+		for _, s := range d.Segments {
+			out.Segments = append(out.Segments, [2]uint32{s[0] + offset, s[1] + offset})
+		}
+		for _, s := range d.Silhouettes {
+			out.Silhouettes = append(out.Silhouettes, SilhouetteEdge{
+				Indices: [2]uint32{s.Indices[0] + offset, s.Indices[1] + offset},
+				Normals: [2]uint16{e.octNormal(k, s.Normals[0]), e.octNormal(k, s.Normals[1])},
+			})
+		}
+		for _, p := range d.Polylines {
+			out.Polylines = append(out.Polylines, offsetIndices(nil, p, offset))
+		}
+	}
+	return out
+}
+
+func (e *instanceExpander) auxChannels(c *AuxChannels) *AuxChannels {
+	out := NewAuxChannels()
+	expandVectors := func(inputs []AuxVectorInput, rotate bool) []AuxVectorInput {
+		result := make([]AuxVectorInput, len(inputs))
+		for j, input := range inputs {
+			result[j].Input = input.Input
+			for k := 0; k < e.count(); k++ {
+				for _, v := range input.Values {
+					if rotate {
+						v = e.data.TransformVector(k, v)
+					}
+					result[j].Values = append(result[j].Values, v)
+				}
+			}
+		}
+		return result
+	}
+	for name, inputs := range c.Displacements {
+		out.Displacements[name] = expandVectors(inputs, true)
+	}
+	for name, inputs := range c.Normals {
+		normals := expandVectors(inputs, true)
+		for j := range normals {
+			for i := range normals[j].Values {
+				normals[j].Values[i] = normalizeVector(normals[j].Values[i])
+			}
+		}
+		out.Normals[name] = normals
+	}
+	for name, inputs := range c.Params {
+		params := make([]AuxScalarInput, len(inputs))
+		for j, input := range inputs {
+			params[j].Input = input.Input
+			for k := 0; k < e.count(); k++ {
+				params[j].Values = append(params[j].Values, input.Values...)
+			}
+		}
+		out.Params[name] = params
+	}
+	return out
+}
+
+func (e *instanceExpander) polylineData(d *PolylineData) *PolylineData {
+	n := uint32(len(d.Vertexs))
+	out := &PolylineData{}
+	for k := 0; k < e.count(); k++ {
+		offset := uint32(k) * n
+		out.Indices = offsetIndices(out.Indices, d.Indices, offset)
+		out.PrevIndices = offsetIndices(out.PrevIndices, d.PrevIndices, offset)
+		out.NextIndices = offsetIndices(out.NextIndices, d.NextIndices, offset)
+		out.Params = append(out.Params, d.Params...)
+		for _, line := range d.Lines {
+			out.Lines = append(out.Lines, offsetIndices(nil, line, offset))
+		}
+		for i := range d.Vertexs {
+			out.Vertexs = append(out.Vertexs, e.vertex(k, d.Vertexs[i]))
+		}
+	}
+	return out
+}
+
+func (e *instanceExpander) pointStringData(d *PointStringData) *PointStringData {
+	n := uint32(len(d.Vertexs))
+	out := &PointStringData{}
+	for k := 0; k < e.count(); k++ {
+		out.Indices = offsetIndices(out.Indices, d.Indices, uint32(k)*n)
+		for i := range d.Vertexs {
+			out.Vertexs = append(out.Vertexs, e.vertex(k, d.Vertexs[i]))
+		}
+	}
+	return out
+}
+
+// worldMeshData returns the data of a mesh with its instances expanded and
+// the vertex table that goes with it, leaving the primitive unchanged.
+func worldMeshData(p *MeshPrimitive) (*MeshData, *VertexTable) {
+	table := p.Vertices
+	if p.Instances == nil || p.Instances.Data == nil {
+		return p.Data, &table
+	}
+	e := newInstanceExpander(p.Instances, p.Vertices.ColorTable)
+	e.updateVertexTable(&table)
+	return e.meshData(p.Data), &table
+}
+
+func worldPolylineData(p *PolylinePrimitive) (*PolylineData, *VertexTable) {
+	table := p.Vertices
+	if p.Instances == nil || p.Instances.Data == nil {
+		return p.Data, &table
+	}
+	e := newInstanceExpander(p.Instances, p.Vertices.ColorTable)
+	e.updateVertexTable(&table)
+	return e.polylineData(p.Data), &table
+}
+
+func worldPointStringData(p *PointStringPrimitive) (*PointStringData, *VertexTable) {
+	table := p.Vertices
+	if p.Instances == nil || p.Instances.Data == nil {
+		return p.Data, &table
+	}
+	e := newInstanceExpander(p.Instances, p.Vertices.ColorTable)
+	e.updateVertexTable(&table)
+	return e.pointStringData(p.Data), &table
+}
+
+func flattenPrimitive(item PrimitiveItem) bool {
+	prim := item.GetPrimitive()
+	if prim == nil || prim.Instances == nil || prim.Instances.Data == nil {
+		return false
+	}
+	e := newInstanceExpander(prim.Instances, prim.Vertices.ColorTable)
+
+	switch p := item.(type) {
+	case *MeshPrimitive:
+		if p.Data == nil {
+			return false
+		}
+		if p.EdgeData != nil {
+			p.EdgeData = e.edgeData(p.EdgeData, len(p.Data.Vertexs))
+		}
+		if p.AuxChannels != nil && p.AuxChannels.Channels != nil {
+			p.AuxChannels.Channels = e.auxChannels(p.AuxChannels.Channels)
+		}
+		p.Data = e.meshData(p.Data)
+	case *PolylinePrimitive:
+		if p.Data == nil {
+			return false
+		}
+		p.Data = e.polylineData(p.Data)
+	case *PointStringPrimitive:
+		if p.Data == nil {
+			return false
+		}
+		p.Data = e.pointStringData(p.Data)
+	default:
+		return false
+	}
+
+	e.updateVertexTable(&prim.Vertices)
+	prim.Instances = nil
+	return true
+}
+
+// flattenedCopy returns a copy of an instanced primitive with its instances
+// expanded, or the primitive itself when it has none.
+func flattenedCopy(item PrimitiveItem) PrimitiveItem {
+	switch p := item.(type) {
+	case *MeshPrimitive:
+		c := *p
+		if p.AuxChannels != nil {
+			// flattenPrimitive replaces the channels of the table in place.
+			aux := *p.AuxChannels
+			c.AuxChannels = &aux
+		}
+		if flattenPrimitive(&c) {
+			return &c
+		}
+	case *PolylinePrimitive:
+		c := *p
+		if flattenPrimitive(&c) {
+			return &c
+		}
+	case *PointStringPrimitive:
+		c := *p
+		if flattenPrimitive(&c) {
+			return &c
+		}
+	}
+	return item
+}
+
+// FlattenInstances expands every instanced primitive into plain geometry,
+// one copy per instance, and returns the number of primitives expanded.
+// Rgb and alpha overrides become vertex colors; weight and line code
+// overrides have no per-vertex equivalent and are dropped.
+func (doc *Document) FlattenInstances() int {
+	count := 0
+	for _, k := range sortedKeys(doc.Meshes) {
+		for _, item := range doc.Meshes[k].Primitives {
+			if flattenPrimitive(item) {
+				count++
+			}
+		}
+	}
+	for _, k := range sortedKeys(doc.PatternSymbols) {
+		for _, item := range doc.PatternSymbols[k].Primitives {
+			if flattenPrimitive(item) {
+				count++
+			}
+		}
+	}
+	return count
+}
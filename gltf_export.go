@@ -0,0 +1,534 @@
+package imdl
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"math"
+
+	"github.com/flywave/gltf"
+	"github.com/flywave/gltf/ext/unlit"
+	"github.com/flywave/gltf/modeler"
+)
+
+const (
+	// FeatureIdAttribute is the custom vertex and instance attribute that
+	// holds feature indices in exported glTF documents.
+	FeatureIdAttribute = "_FEATURE_ID_0"
+
+	extMeshGpuInstancing = "EXT_mesh_gpu_instancing"
+)
+
+// zUpToYUp rotates the z-up tile coordinates into the y-up glTF frame.
+var zUpToYUp = [16]float32{1, 0, 0, 0, 0, 0, -1, 0, 0, 1, 0, 0, 0, 0, 0, 1}
+
+func srgbToLinear(c uint8) float32 {
+	return srgbUnitToLinear(float32(c) / 255)
+}
+
+func srgbUnitToLinear(c float32) float32 {
+	v := float64(c)
+	if v <= 0.04045 {
+		return float32(v / 12.92)
+	}
+	return float32(math.Pow((v+0.055)/1.055, 2.4))
+}
+
+func linearColor(c color.NRGBA) [4]float32 {
+	return [4]float32{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B), float32(c.A) / 255}
+}
+
+func textureMimeType(format TextureFormat) string {
+	if format == FormatPNG {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+func (v *VertexTable) vertexColor(sv *SimpleVertex) color.NRGBA {
+	switch {
+	case sv.Color != nil:
+		return *sv.Color
+	case v.ColorTable != nil && sv.ColorIndex != nil:
+		return v.ColorTable.GetColor(*sv.ColorIndex)
+	case v.ColorTable != nil:
+		return v.ColorTable.GetColor(0)
+	}
+	return ColorFromTbgr(v.UniformColor)
+}
+
+func (v *VertexTable) vertexFeatureId(sv *SimpleVertex) (uint32, bool) {
+	switch v.FeatureIndexType {
+	case Uniform:
+		if v.FeatureId != nil {
+			return *v.FeatureId, true
+		}
+	case NonUniform:
+		if sv.FeatureIndex != nil {
+			return *sv.FeatureIndex, true
+		}
+	}
+	return 0, false
+}
+
+// matrixToTRS splits a row-major 3x4 instance transform into translation,
+// rotation quaternion and scale. Shear is lost.
+func matrixToTRS(m *[12]float32) ([3]float32, [4]float32, [3]float32) {
+	var cols [3]vec3
+	var scale [3]float32
+	for c := 0; c < 3; c++ {
+		cols[c] = vec3{float64(m[c]), float64(m[4+c]), float64(m[8+c])}
+		l := cols[c].length()
+		scale[c] = float32(l)
+		if l > 0 {
+			cols[c] = cols[c].scale(1 / l)
+		}
+	}
+	if cols[0].cross(cols[1]).dot(cols[2]) < 0 {
+		cols[2] = cols[2].scale(-1)
+		scale[2] = -scale[2]
+	}
+
+	r := func(row, col int) float64 { return cols[col][row] }
+	var q [4]float64
+	if trace := r(0, 0) + r(1, 1) + r(2, 2); trace > 0 {
+		s := 0.5 / math.Sqrt(trace+1)
+		q = [4]float64{(r(2, 1) - r(1, 2)) * s, (r(0, 2) - r(2, 0)) * s, (r(1, 0) - r(0, 1)) * s, 0.25 / s}
+	} else if r(0, 0) > r(1, 1) && r(0, 0) > r(2, 2) {
+		s := 2 * math.Sqrt(1+r(0, 0)-r(1, 1)-r(2, 2))
+		q = [4]float64{0.25 * s, (r(0, 1) + r(1, 0)) / s, (r(0, 2) + r(2, 0)) / s, (r(2, 1) - r(1, 2)) / s}
+	} else if r(1, 1) > r(2, 2) {
+		s := 2 * math.Sqrt(1+r(1, 1)-r(0, 0)-r(2, 2))
+		q = [4]float64{(r(0, 1) + r(1, 0)) / s, 0.25 * s, (r(1, 2) + r(2, 1)) / s, (r(0, 2) - r(2, 0)) / s}
+	} else {
+		s := 2 * math.Sqrt(1+r(2, 2)-r(0, 0)-r(1, 1))
+		q = [4]float64{(r(0, 2) + r(2, 0)) / s, (r(1, 2) + r(2, 1)) / s, 0.25 * s, (r(1, 0) - r(0, 1)) / s}
+	}
+
+	return [3]float32{m[3], m[7], m[11]}, [4]float32{float32(q[0]), float32(q[1]), float32(q[2]), float32(q[3])}, scale
+}
+
+type gltfExporter struct {
+	doc       *Document
+	out       *gltf.Document
+	materials map[string]uint32
+	textures  map[string]uint32
+	// featureAttribute is the vertex attribute feature indices go to.
+	featureAttribute string
+	// noFeature is set to give vertices without a feature this index rather
+	// than leaving the attribute out.
+	noFeature *uint32
+}
+
+func newGltfExporter(doc *Document) *gltfExporter {
+	return &gltfExporter{
+		doc:              doc,
+		out:              gltf.NewDocument(),
+		materials:        make(map[string]uint32),
+		textures:         make(map[string]uint32),
+		featureAttribute: FeatureIdAttribute,
+	}
+}
+
+// gltfVertexs holds the attributes shared by every kind of primitive.
+type gltfVertexs struct {
+	positions  [][3]float32
+	colors     [][4]float32
+	featureIds []float32
+	uniform    *color.NRGBA
+}
+
+func (e *gltfExporter) simpleVertexs(table *VertexTable, vertexs []*SimpleVertex) *gltfVertexs {
+	r := &gltfVertexs{positions: make([][3]float32, len(vertexs))}
+	colors := make([]color.NRGBA, len(vertexs))
+	varying := false
+	for i, v := range vertexs {
+		r.positions[i] = v.Pos
+		colors[i] = table.vertexColor(v)
+		varying = varying || colors[i] != colors[0]
+	}
+
+	if varying {
+		r.colors = make([][4]float32, len(colors))
+		for i := range colors {
+			r.colors[i] = linearColor(colors[i])
+		}
+	} else if len(colors) > 0 {
+		r.uniform = &colors[0]
+	}
+
+	if table.FeatureIndexType != Empty || e.noFeature != nil {
+		r.featureIds = make([]float32, len(vertexs))
+		for i, v := range vertexs {
+			id, ok := table.vertexFeatureId(v)
+			if !ok && e.noFeature != nil {
+				id = *e.noFeature
+			}
+			r.featureIds[i] = float32(id)
+		}
+	}
+	return r
+}
+
+func (e *gltfExporter) writeAttributes(v *gltfVertexs, normals [][3]float32, uvs [][2]float32) (gltf.Attribute, error) {
+	attrs := modeler.Attributes{Position: v.positions, Normal: normals}
+	if uvs != nil {
+		attrs.TextureCoord_0 = uvs
+	}
+	if v.colors != nil {
+		attrs.Color = v.colors
+	}
+	if v.featureIds != nil {
+		attrs.CustomAttributes = append(attrs.CustomAttributes, modeler.CustomAttribute{Name: e.featureAttribute, Data: v.featureIds})
+	}
+	return modeler.WriteAttributesInterleaved(e.out, attrs)
+}
+
+func (e *gltfExporter) texture(name string) (uint32, bool, error) {
+	if index, ok := e.textures[name]; ok {
+		return index, true, nil
+	}
+	data, format, err := e.doc.textureImage(name)
+	if err != nil {
+		return 0, false, fmt.Errorf("imdl: exporting texture %q: %w", name, err)
+	}
+	if data == nil {
+		return 0, false, nil
+	}
+
+	image, err := modeler.WriteImage(e.out, name, textureMimeType(format), bytes.NewBuffer(data))
+	if err != nil {
+		return 0, false, fmt.Errorf("imdl: exporting texture %q: %w", name, err)
+	}
+	e.out.Textures = append(e.out.Textures, &gltf.Texture{Name: name, Source: gltf.Index(image)})
+	index := uint32(len(e.out.Textures) - 1)
+	e.textures[name] = index
+	return index, true, nil
+}
+
+// material converts the display params and render material of an imdl
+// material into a PBR material. Uniform vertex colors become the base color
+// factor, so a material is created per distinct color.
+func (e *gltfExporter) material(name string, uniform *color.NRGBA, textured bool, lit bool) (uint32, error) {
+	key := fmt.Sprintf("%s/%v/%v/%v", name, uniform, textured, lit)
+	if index, ok := e.materials[key]; ok {
+		return index, nil
+	}
+
+	pbr := &gltf.PBRMetallicRoughness{MetallicFactor: gltf.Float(0)}
+	baseColor := [4]float32{1, 1, 1, 1}
+	if uniform != nil {
+		baseColor = linearColor(*uniform)
+	}
+	m := &gltf.Material{Name: name, PBRMetallicRoughness: pbr, DoubleSided: true}
+
+	var textureName string
+	if mat, ok := e.doc.Materials[name]; ok {
+		if mat.Texture != nil {
+			textureName = mat.Texture.Name
+		}
+		if rm, ok := e.doc.RenderMaterials[mat.MaterialId]; ok {
+			if rm.DiffuseColor != nil {
+				// Render material colors are sRGB, the base color factor linear.
+				baseColor[0] = srgbUnitToLinear(rm.DiffuseColor[0])
+				baseColor[1] = srgbUnitToLinear(rm.DiffuseColor[1])
+				baseColor[2] = srgbUnitToLinear(rm.DiffuseColor[2])
+			}
+			if rm.Transparency != nil {
+				baseColor[3] *= 1 - *rm.Transparency
+			}
+			if rm.EmissiveColor != nil {
+				m.EmissiveFactor = *rm.EmissiveColor
+			}
+			pbr.RoughnessFactor = gltf.Float(float32(math.Max(0, math.Min(1, float64(1-rm.Specular)))))
+			if textureName == "" && rm.TextureMapping != nil {
+				textureName = rm.TextureMapping.Texture.Name
+			}
+		}
+	}
+
+	if textured && textureName != "" {
+		index, ok, err := e.texture(textureName)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			pbr.BaseColorTexture = &gltf.TextureInfo{Index: index}
+		}
+	}
+
+	pbr.BaseColorFactor = &baseColor
+	if baseColor[3] < 1 {
+		m.AlphaMode = gltf.AlphaBlend
+	}
+	if !lit {
+		m.Extensions = gltf.Extensions{unlit.ExtensionName: unlit.Unlit{}}
+		e.useExtension(unlit.ExtensionName)
+	}
+
+	e.out.Materials = append(e.out.Materials, m)
+	index := uint32(len(e.out.Materials) - 1)
+	e.materials[key] = index
+	return index, nil
+}
+
+func (e *gltfExporter) useExtension(name string) {
+	for _, n := range e.out.ExtensionsUsed {
+		if n == name {
+			return
+		}
+	}
+	e.out.ExtensionsUsed = append(e.out.ExtensionsUsed, name)
+}
+
+func meshNormals(d *MeshData) [][3]float32 {
+	normals := make([][3]float32, len(d.Vertexs))
+	for i := range d.Vertexs {
+		switch {
+		case d.Vertexs[i].Normal != nil:
+			normals[i] = normalizeVector(*d.Vertexs[i].Normal)
+		case d.Vertexs[i].OctEncodedNormal != nil:
+			normals[i] = decodeValue(*d.Vertexs[i].OctEncodedNormal)
+		default:
+			return nil
+		}
+	}
+	return normals
+}
+
+func (e *gltfExporter) meshPrimitive(p *MeshPrimitive) (*gltf.Primitive, error) {
+	d := p.Data
+	vertexs := d.simpleVertexs()
+	v := e.simpleVertexs(&p.Vertices, vertexs)
+
+	lit := d.Type == ST_Lit || d.Type == ST_TexturedLit
+	textured := d.Type == ST_Textured || d.Type == ST_TexturedLit
+	if mat, ok := e.doc.Materials[p.Material]; ok && mat.IgnoreLighting != nil && *mat.IgnoreLighting {
+		lit = false
+	}
+
+	var normals [][3]float32
+	if lit {
+		if normals = meshNormals(d); normals == nil {
+			lit = false
+		}
+	}
+
+	var uvs [][2]float32
+	if textured {
+		uvs = make([][2]float32, len(d.Vertexs))
+		for i := range d.Vertexs {
+			if d.Vertexs[i].UV == nil {
+				uvs, textured = nil, false
+				break
+			}
+			uvs[i] = *d.Vertexs[i].UV
+		}
+	}
+
+	attrs, err := e.writeAttributes(v, normals, uvs)
+	if err != nil {
+		return nil, err
+	}
+	material, err := e.material(p.Material, v.uniform, textured, lit)
+	if err != nil {
+		return nil, err
+	}
+	return &gltf.Primitive{
+		Attributes: attrs,
+		Indices:    gltf.Index(modeler.WriteIndices(e.out, d.Indices)),
+		Material:   gltf.Index(material),
+		Mode:       gltf.PrimitiveTriangles,
+	}, nil
+}
+
+func (e *gltfExporter) polylinePrimitive(p *PolylinePrimitive) (*gltf.Primitive, error) {
+	d := p.Data
+	var indices []uint32
+	for _, line := range d.LineStrings() {
+		for i := 0; i+1 < len(line); i++ {
+			indices = append(indices, line[i], line[i+1])
+		}
+	}
+	if len(indices) == 0 {
+		return nil, nil
+	}
+
+	v := e.simpleVertexs(&p.Vertices, d.simpleVertexs())
+	attrs, err := e.writeAttributes(v, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	material, err := e.material(p.Material, v.uniform, false, false)
+	if err != nil {
+		return nil, err
+	}
+	return &gltf.Primitive{
+		Attributes: attrs,
+		Indices:    gltf.Index(modeler.WriteIndices(e.out, indices)),
+		Material:   gltf.Index(material),
+		Mode:       gltf.PrimitiveLines,
+	}, nil
+}
+
+func (e *gltfExporter) pointStringPrimitive(p *PointStringPrimitive) (*gltf.Primitive, error) {
+	d := p.Data
+	if len(d.Indices) == 0 {
+		return nil, nil
+	}
+
+	v := e.simpleVertexs(&p.Vertices, d.simpleVertexs())
+	attrs, err := e.writeAttributes(v, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	material, err := e.material(p.Material, v.uniform, false, false)
+	if err != nil {
+		return nil, err
+	}
+	return &gltf.Primitive{
+		Attributes: attrs,
+		Indices:    gltf.Index(modeler.WriteIndices(e.out, d.Indices)),
+		Material:   gltf.Index(material),
+		Mode:       gltf.PrimitivePoints,
+	}, nil
+}
+
+func (e *gltfExporter) primitive(item PrimitiveItem) (*gltf.Primitive, error) {
+	switch p := item.(type) {
+	case *MeshPrimitive:
+		if p.Data != nil && len(p.Data.Indices) > 0 {
+			return e.meshPrimitive(p)
+		}
+	case *PolylinePrimitive:
+		if p.Data != nil {
+			return e.polylinePrimitive(p)
+		}
+	case *PointStringPrimitive:
+		if p.Data != nil {
+			return e.pointStringPrimitive(p)
+		}
+	}
+	return nil, nil
+}
+
+// instanceNode places an instanced primitive in a node of its own, with the
+// instance transforms in EXT_mesh_gpu_instancing attributes.
+func (e *gltfExporter) instanceNode(name string, prim *gltf.Primitive, inst *Instances) uint32 {
+	count := inst.Data.Count()
+	center := inst.GetTransformCenter()
+	translations := make([][3]float32, count)
+	rotations := make([][4]float32, count)
+	scales := make([][3]float32, count)
+	for i := range inst.Data.Transforms {
+		t, r, s := matrixToTRS(&inst.Data.Transforms[i])
+		translations[i] = [3]float32{t[0] + center[0], t[1] + center[1], t[2] + center[2]}
+		rotations[i] = r
+		scales[i] = s
+	}
+
+	attrs := map[string]uint32{
+		"TRANSLATION": modeler.WriteAccessor(e.out, gltf.TargetNone, translations),
+		"ROTATION":    modeler.WriteAccessor(e.out, gltf.TargetNone, rotations),
+		"SCALE":       modeler.WriteAccessor(e.out, gltf.TargetNone, scales),
+	}
+	if len(inst.Data.FeatureIds) == count {
+		ids := make([]float32, count)
+		for i, id := range inst.Data.FeatureIds {
+			ids[i] = float32(id)
+		}
+		attrs[FeatureIdAttribute] = modeler.WriteAccessor(e.out, gltf.TargetNone, ids)
+	}
+
+	e.out.Meshes = append(e.out.Meshes, &gltf.Mesh{Name: name, Primitives: []*gltf.Primitive{prim}})
+	e.out.Nodes = append(e.out.Nodes, &gltf.Node{
+		Name:       name,
+		Mesh:       gltf.Index(uint32(len(e.out.Meshes) - 1)),
+		Extensions: gltf.Extensions{extMeshGpuInstancing: map[string]interface{}{"attributes": attrs}},
+	})
+	e.useExtension(extMeshGpuInstancing)
+	return uint32(len(e.out.Nodes) - 1)
+}
+
+func (e *gltfExporter) mesh(nodeName string, meshName string, mesh *Mesh) (uint32, error) {
+	node := &gltf.Node{Name: nodeName}
+	e.out.Nodes = append(e.out.Nodes, node)
+	nodeIndex := uint32(len(e.out.Nodes) - 1)
+
+	gm := &gltf.Mesh{Name: meshName}
+	for i, item := range mesh.Primitives {
+		prim, err := e.primitive(item)
+		if err != nil {
+			return 0, fmt.Errorf("imdl: exporting primitive %d of %q: %w", i, meshName, err)
+		}
+		if prim == nil {
+			continue
+		}
+		if inst := item.GetPrimitive().Instances; inst != nil && inst.Data != nil && inst.Data.Count() > 0 {
+			node.Children = append(node.Children, e.instanceNode(fmt.Sprintf("%s_%d", meshName, i), prim, inst))
+			continue
+		}
+		gm.Primitives = append(gm.Primitives, prim)
+	}
+
+	if len(gm.Primitives) > 0 {
+		e.out.Meshes = append(e.out.Meshes, gm)
+		node.Mesh = gltf.Index(uint32(len(e.out.Meshes) - 1))
+	}
+	return nodeIndex, nil
+}
+
+// ExportGltf converts a decoded document into a glTF 2.0 document. Mesh,
+// polyline and point string primitives become triangle, line and point
+// primitives, feature indices are written to the FeatureIdAttribute vertex
+// attribute and instances use EXT_mesh_gpu_instancing. Pattern symbols and
+// mesh edges are not exported.
+func ExportGltf(doc *Document) (*gltf.Document, error) {
+	return newGltfExporter(doc).export()
+}
+
+func (e *gltfExporter) export() (*gltf.Document, error) {
+	doc := e.doc
+	e.out.Asset.Generator = "flywave/go-imdl"
+	e.out.Nodes = []*gltf.Node{{Name: NODE_ROOT, Matrix: zUpToYUp}}
+	e.out.Scenes[0].Nodes = []uint32{0}
+
+	nodes := doc.Nodes
+	if len(nodes) == 0 {
+		nodes = make(map[string]string)
+		for k := range doc.Meshes {
+			nodes[k] = k
+		}
+	}
+	for _, k := range sortedKeys(nodes) {
+		mesh, ok := doc.Meshes[nodes[k]]
+		if !ok {
+			continue
+		}
+		index, err := e.mesh(k, nodes[k], mesh)
+		if err != nil {
+			return nil, err
+		}
+		e.out.Nodes[0].Children = append(e.out.Nodes[0].Children, index)
+	}
+	return e.out, nil
+}
+
+func SaveGltf(doc *Document, name string) error {
+	out, err := ExportGltf(doc)
+	if err != nil {
+		return err
+	}
+	for _, b := range out.Buffers {
+		b.EmbeddedResource()
+	}
+	return gltf.Save(out, name)
+}
+
+func SaveGlb(doc *Document, name string) error {
+	out, err := ExportGltf(doc)
+	if err != nil {
+		return err
+	}
+	return gltf.SaveBinary(out, name)
+}
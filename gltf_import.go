@@ -0,0 +1,875 @@
+package imdl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+
+	"github.com/flywave/gltf"
+	"github.com/flywave/gltf/ext/unlit"
+	"github.com/flywave/gltf/modeler"
+)
+
+const MESH_ROOT = "Mesh_Root"
+
+// mat4 is a column-major 4x4 matrix.
+type mat4 [16]float64
+
+var identityMat4 = mat4{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1}
+
+// yUpToZUp rotates the y-up glTF frame into z-up tile coordinates.
+var yUpToZUp = mat4{1, 0, 0, 0, 0, 0, 1, 0, 0, -1, 0, 0, 0, 0, 0, 1}
+
+func (a mat4) mul(b mat4) mat4 {
+	var r mat4
+	for c := 0; c < 4; c++ {
+		for row := 0; row < 4; row++ {
+			for k := 0; k < 4; k++ {
+				r[c*4+row] += a[k*4+row] * b[c*4+k]
+			}
+		}
+	}
+	return r
+}
+
+func trsMat4(t [3]float32, q [4]float32, s [3]float32) mat4 {
+	x, y, z, w := float64(q[0]), float64(q[1]), float64(q[2]), float64(q[3])
+	return mat4{
+		(1 - 2*(y*y+z*z)) * float64(s[0]), 2 * (x*y + z*w) * float64(s[0]), 2 * (x*z - y*w) * float64(s[0]), 0,
+		2 * (x*y - z*w) * float64(s[1]), (1 - 2*(x*x+z*z)) * float64(s[1]), 2 * (y*z + x*w) * float64(s[1]), 0,
+		2 * (x*z + y*w) * float64(s[2]), 2 * (y*z - x*w) * float64(s[2]), (1 - 2*(x*x+y*y)) * float64(s[2]), 0,
+		float64(t[0]), float64(t[1]), float64(t[2]), 1,
+	}
+}
+
+func nodeMat4(n *gltf.Node) mat4 {
+	if m := n.MatrixOrDefault(); m != gltf.DefaultMatrix {
+		var r mat4
+		for i := range m {
+			r[i] = float64(m[i])
+		}
+		return r
+	}
+	return trsMat4(n.TranslationOrDefault(), n.RotationOrDefault(), n.ScaleOrDefault())
+}
+
+func (a mat4) transformPoint(p [3]float32) [3]float32 {
+	x, y, z := float64(p[0]), float64(p[1]), float64(p[2])
+	return [3]float32{
+		float32(a[0]*x + a[4]*y + a[8]*z + a[12]),
+		float32(a[1]*x + a[5]*y + a[9]*z + a[13]),
+		float32(a[2]*x + a[6]*y + a[10]*z + a[14]),
+	}
+}
+
+func (a mat4) determinant3() float64 {
+	return a[0]*(a[5]*a[10]-a[9]*a[6]) - a[4]*(a[1]*a[10]-a[9]*a[2]) + a[8]*(a[1]*a[6]-a[5]*a[2])
+}
+
+// transformNormal applies the cofactor matrix, which is the inverse
+// transpose scaled by the determinant, so normals stay perpendicular under
+// non-uniform scale.
+func (a mat4) transformNormal(n [3]float32) [3]float32 {
+	c0 := vec3{a[0], a[1], a[2]}
+	c1 := vec3{a[4], a[5], a[6]}
+	c2 := vec3{a[8], a[9], a[10]}
+	cof := [3]vec3{c1.cross(c2), c2.cross(c0), c0.cross(c1)}
+	v := toVec3(n)
+	r := cof[0].scale(v[0]).add(cof[1].scale(v[1])).add(cof[2].scale(v[2]))
+	if a.determinant3() < 0 {
+		r = r.scale(-1)
+	}
+	return normalizeVector([3]float32{float32(r[0]), float32(r[1]), float32(r[2])})
+}
+
+func linearToSrgb(v float32) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 1 {
+		return 255
+	}
+	var s float64
+	if v < 0.0031308 {
+		s = float64(v) * 12.92
+	} else {
+		s = 1.055*math.Pow(float64(v), 1/2.4) - 0.055
+	}
+	return uint8(math.Round(s * 255))
+}
+
+func srgbColor(c [4]float32) color.NRGBA {
+	return color.NRGBA{R: linearToSrgb(c[0]), G: linearToSrgb(c[1]), B: linearToSrgb(c[2]), A: uint8(math.Round(float64(c[3]) * 255))}
+}
+
+func textureFormatOf(mimeType string, data []byte) (TextureFormat, bool) {
+	switch {
+	case mimeType == "image/png" || bytes.HasPrefix(data, []byte("\x89PNG")):
+		return FormatPNG, true
+	case mimeType == "image/jpeg" || bytes.HasPrefix(data, []byte("\xff\xd8")):
+		return FormatJPG, true
+	}
+	return 0, false
+}
+
+type gltfImporter struct {
+	src         *gltf.Document
+	doc         *Document
+	dir         string
+	mesh        *Mesh
+	textures    map[uint32]string
+	unsupported map[string]bool
+}
+
+func (im *gltfImporter) report(format string, args ...interface{}) {
+	im.unsupported[fmt.Sprintf(format, args...)] = true
+}
+
+func (im *gltfImporter) imageData(img *gltf.Image) ([]byte, error) {
+	switch {
+	case img.BufferView != nil:
+		if int(*img.BufferView) >= len(im.src.BufferViews) {
+			return nil, fmt.Errorf("imdl: image %q refers to a missing bufferView", img.Name)
+		}
+		return modeler.ReadBufferView(im.src, im.src.BufferViews[*img.BufferView])
+	case img.IsEmbeddedResource():
+		return img.MarshalData()
+	case img.URI != "" && im.dir != "":
+		return ioutil.ReadFile(filepath.Join(im.dir, filepath.FromSlash(img.URI)))
+	}
+	return nil, nil
+}
+
+// texture converts the image of a glTF texture into a named texture and
+// returns its name, or "" when the image can't be represented.
+func (im *gltfImporter) texture(index uint32) (string, error) {
+	if name, ok := im.textures[index]; ok {
+		return name, nil
+	}
+	im.textures[index] = ""
+	if int(index) >= len(im.src.Textures) {
+		return "", fmt.Errorf("imdl: texture %d is missing", index)
+	}
+	t := im.src.Textures[index]
+	for name := range t.Extensions {
+		im.report("texture extension %s", name)
+	}
+	if t.Source == nil || int(*t.Source) >= len(im.src.Images) {
+		return "", nil
+	}
+
+	img := im.src.Images[*t.Source]
+	data, err := im.imageData(img)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 {
+		im.report("external image %q", img.URI)
+		return "", nil
+	}
+	format, ok := textureFormatOf(img.MimeType, data)
+	if !ok {
+		im.report("image type %q", img.MimeType)
+		return "", nil
+	}
+	decoded := DecodeTexture(data, format)
+	if decoded == nil {
+		return "", fmt.Errorf("imdl: image %d can't be decoded", *t.Source)
+	}
+
+	name := fmt.Sprintf("Texture%d", index)
+	size := decoded.Bounds().Size()
+	im.doc.NamedTextures[name] = &RenderTexture{Format: uint32(format), Width: uint32(size.X), Height: uint32(size.Y), TextureData: decoded}
+	im.textures[index] = name
+	return name, nil
+}
+
+type gltfMaterial struct {
+	name      string
+	baseColor [4]float32
+	texture   string
+	unlit     bool
+}
+
+// material converts a glTF material into an imdl material and the render
+// material it refers to. index is -1 for primitives without a material.
+func (im *gltfImporter) material(index int) (*gltfMaterial, error) {
+	m := &gltfMaterial{baseColor: [4]float32{1, 1, 1, 1}}
+	var src *gltf.Material
+	if index >= 0 && index < len(im.src.Materials) {
+		src = im.src.Materials[index]
+	} else {
+		index = -1
+	}
+
+	if src != nil {
+		if pbr := src.PBRMetallicRoughness; pbr != nil {
+			m.baseColor = pbr.BaseColorFactorOrDefault()
+			if pbr.BaseColorTexture != nil {
+				if pbr.BaseColorTexture.TexCoord != 0 {
+					im.report("texture coordinate set %d", pbr.BaseColorTexture.TexCoord)
+				} else {
+					name, err := im.texture(pbr.BaseColorTexture.Index)
+					if err != nil {
+						return nil, err
+					}
+					m.texture = name
+				}
+				for ext := range pbr.BaseColorTexture.Extensions {
+					im.report("texture extension %s", ext)
+				}
+			}
+			if pbr.MetallicRoughnessTexture != nil {
+				im.report("metallic roughness textures")
+			}
+		}
+		if src.NormalTexture != nil {
+			im.report("normal textures")
+		}
+		if src.OcclusionTexture != nil {
+			im.report("occlusion textures")
+		}
+		if src.EmissiveTexture != nil {
+			im.report("emissive textures")
+		}
+		if src.AlphaMode == gltf.AlphaMask {
+			im.report("alpha mask materials")
+		}
+		for ext := range src.Extensions {
+			if ext == unlit.ExtensionName {
+				m.unlit = true
+			} else {
+				im.report("material extension %s", ext)
+			}
+		}
+	}
+
+	if index < 0 {
+		m.name = "MaterialDefault"
+	} else {
+		m.name = fmt.Sprintf("Material%d", index)
+	}
+	if _, ok := im.doc.Materials[m.name]; ok {
+		return m, nil
+	}
+
+	renderMaterialId := fmt.Sprintf("RenderMaterial%d", index+1)
+	rm := &RenderMaterial{Diffuse: 1, SpecularExponent: 13.5}
+	diffuse := srgbColor(m.baseColor)
+	rm.DiffuseColor = &[3]float32{float32(diffuse.R) / 255, float32(diffuse.G) / 255, float32(diffuse.B) / 255}
+	if m.baseColor[3] < 1 {
+		transparency := 1 - m.baseColor[3]
+		rm.Transparency = &transparency
+	}
+	if src != nil {
+		if src.PBRMetallicRoughness != nil {
+			rm.Specular = 1 - src.PBRMetallicRoughness.RoughnessFactorOrDefault()
+		}
+		if src.EmissiveFactor != [3]float32{} {
+			emissive := src.EmissiveFactor
+			rm.EmissiveColor = &emissive
+		}
+	}
+
+	addImportedMaterial(im.doc, m.name, renderMaterialId, rm, diffuse, m.texture, m.unlit)
+	return m, nil
+}
+
+// addImportedMaterial adds a material with its render material, mapping the
+// named texture parametrically when there is one.
+func addImportedMaterial(doc *Document, name string, renderMaterialId string, rm *RenderMaterial, diffuse color.NRGBA, texture string, unlit bool) {
+	tbgr := ColorToTbgr(diffuse)
+	width := uint32(1)
+	mat := &Material{MaterialId: renderMaterialId, FillColor: &tbgr, LineColor: &tbgr, LineWidth: &width}
+	if unlit {
+		ignoreLighting := true
+		mat.IgnoreLighting = &ignoreLighting
+	}
+	if texture != "" {
+		t := Texture{Name: texture}
+		t.Params.Mode = TM_Parametric
+		t.Params.TextureMatrix = [][3]float64{{1, 0, 0}, {0, 1, 0}}
+		t.Params.Weight = 1
+		mat.Texture = &t
+		rm.TextureMapping = &TextureMapping{Texture: t}
+	}
+
+	doc.Materials[name] = mat
+	doc.RenderMaterials[renderMaterialId] = rm
+}
+
+func (im *gltfImporter) accessor(index uint32) (*gltf.Accessor, error) {
+	if int(index) >= len(im.src.Accessors) {
+		return nil, fmt.Errorf("imdl: accessor %d is missing", index)
+	}
+	return im.src.Accessors[index], nil
+}
+
+func (im *gltfImporter) readColors(acr *gltf.Accessor) ([][4]float32, error) {
+	data, err := modeler.ReadAccessor(im.src, acr, nil)
+	if err != nil {
+		return nil, err
+	}
+	colors := make([][4]float32, acr.Count)
+	for i := range colors {
+		colors[i][3] = 1
+	}
+	switch d := data.(type) {
+	case [][3]float32:
+		for i, c := range d {
+			colors[i] = [4]float32{c[0], c[1], c[2], 1}
+		}
+	case [][4]float32:
+		copy(colors, d)
+	case [][3]uint8:
+		for i, c := range d {
+			colors[i] = [4]float32{float32(c[0]) / 255, float32(c[1]) / 255, float32(c[2]) / 255, 1}
+		}
+	case [][4]uint8:
+		for i, c := range d {
+			colors[i] = [4]float32{float32(c[0]) / 255, float32(c[1]) / 255, float32(c[2]) / 255, float32(c[3]) / 255}
+		}
+	case [][3]uint16:
+		for i, c := range d {
+			colors[i] = [4]float32{float32(c[0]) / 65535, float32(c[1]) / 65535, float32(c[2]) / 65535, 1}
+		}
+	case [][4]uint16:
+		for i, c := range d {
+			colors[i] = [4]float32{float32(c[0]) / 65535, float32(c[1]) / 65535, float32(c[2]) / 65535, float32(c[3]) / 65535}
+		}
+	default:
+		return nil, fmt.Errorf("imdl: unsupported color accessor %T", data)
+	}
+	return colors, nil
+}
+
+func (im *gltfImporter) readFeatureIds(acr *gltf.Accessor) ([]uint32, error) {
+	data, err := modeler.ReadAccessor(im.src, acr, nil)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint32, acr.Count)
+	switch d := data.(type) {
+	case []float32:
+		for i, v := range d {
+			ids[i] = uint32(v)
+		}
+	case []uint8:
+		for i, v := range d {
+			ids[i] = uint32(v)
+		}
+	case []uint16:
+		for i, v := range d {
+			ids[i] = uint32(v)
+		}
+	case []uint32:
+		copy(ids, d)
+	default:
+		return nil, fmt.Errorf("imdl: unsupported feature id accessor %T", data)
+	}
+	return ids, nil
+}
+
+// gltfAttributes holds the vertex attributes of a glTF primitive in world
+// space.
+type gltfAttributes struct {
+	positions  [][3]float32
+	normals    [][3]float32
+	uvs        [][2]float32
+	colors     []color.NRGBA
+	featureIds []uint32
+}
+
+func (im *gltfImporter) attributes(p *gltf.Primitive, m mat4, mat *gltfMaterial) (*gltfAttributes, error) {
+	r := &gltfAttributes{}
+	for _, name := range sortedKeys(p.Attributes) {
+		acr, err := im.accessor(p.Attributes[name])
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case gltf.POSITION:
+			if r.positions, err = modeler.ReadPosition(im.src, acr, nil); err != nil {
+				return nil, err
+			}
+		case gltf.NORMAL:
+			if r.normals, err = modeler.ReadNormal(im.src, acr, nil); err != nil {
+				return nil, err
+			}
+		case gltf.TEXCOORD_0:
+			if r.uvs, err = modeler.ReadTextureCoord(im.src, acr, nil); err != nil {
+				return nil, err
+			}
+		case gltf.COLOR_0:
+			colors, err := im.readColors(acr)
+			if err != nil {
+				return nil, err
+			}
+			r.colors = make([]color.NRGBA, len(colors))
+			for i, c := range colors {
+				r.colors[i] = srgbColor([4]float32{c[0] * mat.baseColor[0], c[1] * mat.baseColor[1], c[2] * mat.baseColor[2], c[3] * mat.baseColor[3]})
+			}
+		case FeatureIdAttribute:
+			if r.featureIds, err = im.readFeatureIds(acr); err != nil {
+				return nil, err
+			}
+		default:
+			im.report("attribute %s", name)
+		}
+	}
+
+	n := len(r.positions)
+	if n == 0 {
+		return nil, nil
+	}
+	if len(r.normals) != n {
+		r.normals = nil
+	}
+	if len(r.uvs) != n {
+		r.uvs = nil
+	}
+	if len(r.featureIds) != n {
+		r.featureIds = nil
+	}
+	if len(r.colors) != n {
+		r.colors = make([]color.NRGBA, n)
+		for i := range r.colors {
+			r.colors[i] = srgbColor(mat.baseColor)
+		}
+	}
+
+	for i := range r.positions {
+		r.positions[i] = m.transformPoint(r.positions[i])
+	}
+	for i := range r.normals {
+		r.normals[i] = m.transformNormal(r.normals[i])
+	}
+	return r, nil
+}
+
+func (a *gltfAttributes) simpleVertex(i int) SimpleVertex {
+	c := a.colors[i]
+	v := SimpleVertex{Pos: a.positions[i], Color: &c}
+	if a.featureIds != nil {
+		id := a.featureIds[i]
+		v.FeatureIndex = &id
+	}
+	return v
+}
+
+func (a *gltfAttributes) updateVertexTable(v *VertexTable) {
+	if a.featureIds == nil {
+		v.FeatureIndexType = Empty
+		return
+	}
+	for i := range a.featureIds {
+		if a.featureIds[i] != a.featureIds[0] {
+			v.FeatureIndexType = NonUniform
+			return
+		}
+	}
+	id := a.featureIds[0]
+	v.FeatureIndexType = Uniform
+	v.FeatureId = &id
+}
+
+func (im *gltfImporter) indices(p *gltf.Primitive, count int) ([]uint32, error) {
+	if p.Indices == nil {
+		indices := make([]uint32, count)
+		for i := range indices {
+			indices[i] = uint32(i)
+		}
+		return indices, nil
+	}
+	acr, err := im.accessor(*p.Indices)
+	if err != nil {
+		return nil, err
+	}
+	indices, err := modeler.ReadIndices(im.src, acr, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range indices {
+		if int(i) >= count {
+			return nil, fmt.Errorf("imdl: index %d is out of range", i)
+		}
+	}
+	return indices, nil
+}
+
+func triangleIndices(mode gltf.PrimitiveMode, indices []uint32, flip bool) []uint32 {
+	var out []uint32
+	add := func(a, b, c uint32) {
+		if a == b || b == c || a == c {
+			return
+		}
+		if flip {
+			a, b = b, a
+		}
+		out = append(out, a, b, c)
+	}
+	switch mode {
+	case gltf.PrimitiveTriangleStrip:
+		for i := 0; i+2 < len(indices); i++ {
+			if i%2 == 0 {
+				add(indices[i], indices[i+1], indices[i+2])
+			} else {
+				add(indices[i+1], indices[i], indices[i+2])
+			}
+		}
+	case gltf.PrimitiveTriangleFan:
+		for i := 1; i+1 < len(indices); i++ {
+			add(indices[0], indices[i], indices[i+1])
+		}
+	default:
+		for i := 0; i+2 < len(indices); i += 3 {
+			add(indices[i], indices[i+1], indices[i+2])
+		}
+	}
+	return out
+}
+
+// lineStrings joins line segments that share end points into line strings.
+func lineStrings(mode gltf.PrimitiveMode, indices []uint32) [][]uint32 {
+	switch mode {
+	case gltf.PrimitiveLineStrip:
+		return [][]uint32{indices}
+	case gltf.PrimitiveLineLoop:
+		if len(indices) == 0 {
+			return nil
+		}
+		return [][]uint32{append(append([]uint32{}, indices...), indices[0])}
+	}
+
+	var lines [][]uint32
+	for i := 0; i+1 < len(indices); i += 2 {
+		if n := len(lines); n > 0 && lines[n-1][len(lines[n-1])-1] == indices[i] {
+			lines[n-1] = append(lines[n-1], indices[i+1])
+			continue
+		}
+		lines = append(lines, []uint32{indices[i], indices[i+1]})
+	}
+	return lines
+}
+
+// primitive appends the world space geometry of a glTF primitive. featureId
+// is set for instances, whose feature id overrides the vertex ones.
+func (im *gltfImporter) primitive(p *gltf.Primitive, m mat4, featureId *uint32) error {
+	if len(p.Targets) > 0 {
+		im.report("morph targets")
+	}
+	for ext := range p.Extensions {
+		im.report("primitive extension %s", ext)
+	}
+
+	materialIndex := -1
+	if p.Material != nil {
+		materialIndex = int(*p.Material)
+	}
+	mat, err := im.material(materialIndex)
+	if err != nil {
+		return err
+	}
+	attrs, err := im.attributes(p, m, mat)
+	if err != nil || attrs == nil {
+		return err
+	}
+	if featureId != nil {
+		attrs.featureIds = make([]uint32, len(attrs.positions))
+		for i := range attrs.featureIds {
+			attrs.featureIds[i] = *featureId
+		}
+	}
+	indices, err := im.indices(p, len(attrs.positions))
+	if err != nil {
+		return err
+	}
+
+	switch p.Mode {
+	case gltf.PrimitiveTriangles, gltf.PrimitiveTriangleStrip, gltf.PrimitiveTriangleFan:
+		lit := attrs.normals != nil && !mat.unlit
+		textured := attrs.uvs != nil && mat.texture != ""
+		data := &MeshData{Type: ST_Unlit, Indices: triangleIndices(p.Mode, indices, m.determinant3() < 0)}
+		switch {
+		case lit && textured:
+			data.Type = ST_TexturedLit
+		case lit:
+			data.Type = ST_Lit
+		case textured:
+			data.Type = ST_Textured
+		}
+		if len(data.Indices) == 0 {
+			return nil
+		}
+
+		data.Vertexs = make([]MeshVertex, len(attrs.positions))
+		for i := range data.Vertexs {
+			v := &data.Vertexs[i]
+			v.SimpleVertex = attrs.simpleVertex(i)
+			if lit {
+				normal := attrs.normals[i]
+				v.Normal = &normal
+			}
+			if textured {
+				uv := attrs.uvs[i]
+				v.UV = &uv
+			}
+		}
+
+		prim := &MeshPrimitive{Type: PT_Mesh, Data: data}
+		prim.Material = mat.name
+		prim.Surface.Type = data.Type
+		attrs.updateVertexTable(&prim.Vertices)
+		im.mesh.Primitives = append(im.mesh.Primitives, prim)
+	case gltf.PrimitiveLines, gltf.PrimitiveLineStrip, gltf.PrimitiveLineLoop:
+		lines := lineStrings(p.Mode, indices)
+		if len(lines) == 0 {
+			return nil
+		}
+		data := &PolylineData{Lines: lines, Vertexs: make([]SimpleVertex, len(attrs.positions))}
+		for i := range data.Vertexs {
+			data.Vertexs[i] = attrs.simpleVertex(i)
+		}
+		prim := &PolylinePrimitive{Type: PT_Polyline, Data: data}
+		prim.Material = mat.name
+		attrs.updateVertexTable(&prim.Vertices)
+		im.mesh.Primitives = append(im.mesh.Primitives, prim)
+	case gltf.PrimitivePoints:
+		data := &PointStringData{Indices: indices, Vertexs: make([]SimpleVertex, len(attrs.positions))}
+		for i := range data.Vertexs {
+			data.Vertexs[i] = attrs.simpleVertex(i)
+		}
+		prim := &PointStringPrimitive{Type: PT_Point, Data: data}
+		prim.Material = mat.name
+		attrs.updateVertexTable(&prim.Vertices)
+		im.mesh.Primitives = append(im.mesh.Primitives, prim)
+	}
+	return nil
+}
+
+type gltfInstance struct {
+	transform mat4
+	featureId *uint32
+}
+
+// instances reads the EXT_mesh_gpu_instancing transforms and feature ids
+// of a node.
+func (im *gltfImporter) instances(ext interface{}) ([]gltfInstance, error) {
+	raw, ok := ext.(json.RawMessage)
+	if !ok {
+		var err error
+		if raw, err = json.Marshal(ext); err != nil {
+			return nil, err
+		}
+	}
+	var inst struct {
+		Attributes map[string]uint32 `json:"attributes"`
+	}
+	if err := json.Unmarshal(raw, &inst); err != nil {
+		return nil, err
+	}
+
+	var count uint32
+	var translations, scales [][3]float32
+	var rotations [][4]float32
+	var featureIds []uint32
+	for _, name := range sortedKeys(inst.Attributes) {
+		acr, err := im.accessor(inst.Attributes[name])
+		if err != nil {
+			return nil, err
+		}
+		count = acr.Count
+		if name == FeatureIdAttribute {
+			if featureIds, err = im.readFeatureIds(acr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		data, err := modeler.ReadAccessor(im.src, acr, nil)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "TRANSLATION":
+			translations, _ = data.([][3]float32)
+		case "ROTATION":
+			rotations, _ = data.([][4]float32)
+			if rotations == nil {
+				im.report("quantized instance rotations")
+			}
+		case "SCALE":
+			scales, _ = data.([][3]float32)
+		default:
+			im.report("instance attribute %s", name)
+		}
+	}
+
+	instances := make([]gltfInstance, count)
+	for i := range instances {
+		t, r, s := [3]float32{}, gltf.DefaultRotation, gltf.DefaultScale
+		if i < len(translations) {
+			t = translations[i]
+		}
+		if i < len(rotations) {
+			r = rotations[i]
+		}
+		if i < len(scales) {
+			s = scales[i]
+		}
+		instances[i].transform = trsMat4(t, r, s)
+		if i < len(featureIds) {
+			instances[i].featureId = &featureIds[i]
+		}
+	}
+	return instances, nil
+}
+
+func (im *gltfImporter) node(index uint32, parent mat4, depth int) error {
+	if int(index) >= len(im.src.Nodes) || depth > len(im.src.Nodes) {
+		return fmt.Errorf("imdl: node %d is missing or part of a cycle", index)
+	}
+	n := im.src.Nodes[index]
+	m := parent.mul(nodeMat4(n))
+
+	if n.Skin != nil {
+		im.report("skins")
+	}
+	if n.Camera != nil {
+		im.report("cameras")
+	}
+
+	instances := []gltfInstance{{transform: identityMat4}}
+	for name, ext := range n.Extensions {
+		if name != extMeshGpuInstancing {
+			im.report("node extension %s", name)
+			continue
+		}
+		inst, err := im.instances(ext)
+		if err != nil {
+			return err
+		}
+		if inst != nil {
+			instances = inst
+		}
+	}
+
+	if n.Mesh != nil {
+		if int(*n.Mesh) >= len(im.src.Meshes) {
+			return fmt.Errorf("imdl: mesh %d is missing", *n.Mesh)
+		}
+		for _, inst := range instances {
+			for _, p := range im.src.Meshes[*n.Mesh].Primitives {
+				if err := im.primitive(p, m.mul(inst.transform), inst.featureId); err != nil {
+					return fmt.Errorf("imdl: importing mesh %d: %w", *n.Mesh, err)
+				}
+			}
+		}
+	}
+
+	for _, c := range n.Children {
+		if err := im.node(c, m, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *gltfImporter) sceneNodes() []uint32 {
+	if len(im.src.Scenes) > 0 {
+		scene := uint32(0)
+		if im.src.Scene != nil && int(*im.src.Scene) < len(im.src.Scenes) {
+			scene = *im.src.Scene
+		}
+		if len(im.src.Scenes) > 1 {
+			im.report("multiple scenes")
+		}
+		return im.src.Scenes[scene].Nodes
+	}
+
+	isChild := make([]bool, len(im.src.Nodes))
+	for _, n := range im.src.Nodes {
+		for _, c := range n.Children {
+			if int(c) < len(isChild) {
+				isChild[c] = true
+			}
+		}
+	}
+	var roots []uint32
+	for i := range im.src.Nodes {
+		if !isChild[i] {
+			roots = append(roots, uint32(i))
+		}
+	}
+	return roots
+}
+
+// newImportDocument returns an empty document with a single mesh for the
+// imported primitives.
+func newImportDocument() *Document {
+	doc := NewDocument()
+	doc.Nodes = map[string]string{NODE_ROOT: MESH_ROOT}
+	doc.Meshes = map[string]*Mesh{MESH_ROOT: {}}
+	doc.Materials = make(map[string]*Material)
+	doc.RenderMaterials = make(map[string]*RenderMaterial)
+	doc.NamedTextures = make(map[string]*RenderTexture)
+	return doc
+}
+
+func importGltf(src *gltf.Document, dir string) (*Document, []string, error) {
+	doc := newImportDocument()
+
+	im := &gltfImporter{
+		src:         src,
+		doc:         doc,
+		dir:         dir,
+		mesh:        doc.Meshes[MESH_ROOT],
+		textures:    make(map[uint32]string),
+		unsupported: make(map[string]bool),
+	}
+
+	if len(src.Animations) > 0 {
+		im.report("animations")
+	}
+	for _, name := range src.ExtensionsRequired {
+		switch name {
+		case unlit.ExtensionName, extMeshGpuInstancing:
+		default:
+			return nil, nil, fmt.Errorf("imdl: required glTF extension %s is not supported", name)
+		}
+	}
+
+	for _, n := range im.sceneNodes() {
+		if err := im.node(n, yUpToZUp, 0); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	unsupported := make([]string, 0, len(im.unsupported))
+	for k := range im.unsupported {
+		unsupported = append(unsupported, k)
+	}
+	sort.Strings(unsupported)
+	return doc, unsupported, nil
+}
+
+// ImportGltf converts the default scene of a glTF document into a document
+// whose primitives are in world space, with y-up converted to z-up. It also
+// returns a description of every glTF feature that was dropped because it
+// has no imdl equivalent, such as skins, animations or normal textures.
+// Images referenced by an external uri are only loaded by OpenGltf.
+func ImportGltf(src *gltf.Document) (*Document, []string, error) {
+	return importGltf(src, "")
+}
+
+func OpenGltf(name string) (*Document, []string, error) {
+	src, err := gltf.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return importGltf(src, filepath.Dir(name))
+}
@@ -15,7 +15,10 @@ func encodeIndex(index uint32, bytes []byte, byteIndex int) error {
 }
 
 func decodeIndex(index int, bytes []byte) uint32 {
-	byteIndex := index * 3
+	return decodeIndexAt(bytes, index*3)
+}
+
+func decodeIndexAt(bytes []byte, byteIndex int) uint32 {
 	return uint32(bytes[byteIndex]) | uint32(bytes[byteIndex+1])<<8 | uint32(bytes[byteIndex+2])<<16
 }
 
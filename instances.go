@@ -0,0 +1,174 @@
+package imdl
+
+import (
+	"encoding/binary"
+	"image/color"
+	"math"
+)
+
+type InstanceOverrideFlags uint8
+
+const (
+	IO_None     InstanceOverrideFlags = 0
+	IO_Rgb      InstanceOverrideFlags = 1 << 1
+	IO_Alpha    InstanceOverrideFlags = 1 << 2
+	IO_LineCode InstanceOverrideFlags = 1 << 6
+	IO_Weight   InstanceOverrideFlags = 1 << 7
+)
+
+/**
+ *  Each symbology override consists of 8 bytes:
+ *  flags           00
+ *  weight          01
+ *  lineCode        02
+ *  unused          03
+ *  rgba            04
+ */
+type InstanceOverride struct {
+	Flags    InstanceOverrideFlags
+	Weight   uint8
+	LineCode uint8
+	Color    color.NRGBA
+}
+
+func (o *InstanceOverride) HasFlag(flag InstanceOverrideFlags) bool {
+	return o.Flags&flag != 0
+}
+
+type InstanceData struct {
+	Transforms         [][12]float32
+	FeatureIds         []uint32
+	SymbologyOverrides []InstanceOverride
+}
+
+func (d *InstanceData) Count() int {
+	return len(d.Transforms)
+}
+
+func (d *InstanceData) TransformPoint(index int, center [3]float32, p [3]float32) [3]float32 {
+	m := &d.Transforms[index]
+	return [3]float32{
+		m[0]*p[0] + m[1]*p[1] + m[2]*p[2] + m[3] + center[0],
+		m[4]*p[0] + m[5]*p[1] + m[6]*p[2] + m[7] + center[1],
+		m[8]*p[0] + m[9]*p[1] + m[10]*p[2] + m[11] + center[2],
+	}
+}
+
+func (d *InstanceData) TransformVector(index int, v [3]float32) [3]float32 {
+	m := &d.Transforms[index]
+	return [3]float32{
+		m[0]*v[0] + m[1]*v[1] + m[2]*v[2],
+		m[4]*v[0] + m[5]*v[1] + m[6]*v[2],
+		m[8]*v[0] + m[9]*v[1] + m[10]*v[2],
+	}
+}
+
+func DecodeInstanceTransforms(data []byte) [][12]float32 {
+	transforms := make([][12]float32, len(data)/48)
+	for i := range transforms {
+		for j := 0; j < 12; j++ {
+			transforms[i][j] = math.Float32frombits(binary.LittleEndian.Uint32(data[i*48+j*4:]))
+		}
+	}
+	return transforms
+}
+
+func EncodeInstanceTransforms(transforms [][12]float32) []byte {
+	data := make([]byte, len(transforms)*48)
+	for i := range transforms {
+		for j := 0; j < 12; j++ {
+			binary.LittleEndian.PutUint32(data[i*48+j*4:], math.Float32bits(transforms[i][j]))
+		}
+	}
+	return data
+}
+
+func DecodeInstanceFeatureIds(data []byte) []uint32 {
+	return DecodeVertexIndices(data)
+}
+
+func EncodeInstanceFeatureIds(featureIds []uint32) []byte {
+	return EncodeVertexIndices(featureIds)
+}
+
+func DecodeInstanceOverrides(data []byte) []InstanceOverride {
+	overrides := make([]InstanceOverride, len(data)/8)
+	for i := range overrides {
+		b := data[i*8 : i*8+8]
+		overrides[i] = InstanceOverride{
+			Flags:    InstanceOverrideFlags(b[0]),
+			Weight:   b[1],
+			LineCode: b[2],
+			Color:    color.NRGBA{R: b[4], G: b[5], B: b[6], A: b[7]},
+		}
+	}
+	return overrides
+}
+
+func EncodeInstanceOverrides(overrides []InstanceOverride) []byte {
+	data := make([]byte, len(overrides)*8)
+	for i := range overrides {
+		b := data[i*8 : i*8+8]
+		b[0] = byte(overrides[i].Flags)
+		b[1] = overrides[i].Weight
+		b[2] = overrides[i].LineCode
+		b[4] = overrides[i].Color.R
+		b[5] = overrides[i].Color.G
+		b[6] = overrides[i].Color.B
+		b[7] = overrides[i].Color.A
+	}
+	return data
+}
+
+func (i *Instances) GetTransformCenter() [3]float32 {
+	var center [3]float32
+	copy(center[:], i.TransformCenter)
+	return center
+}
+
+func (i *Instances) decodeData(chunkMap map[string]*chunkData) {
+	i.Data = &InstanceData{}
+	if cd, ok := chunkMap[i.Transforms]; ok {
+		i.Data.Transforms = DecodeInstanceTransforms(cd.data)
+	}
+	if cd, ok := chunkMap[i.FeatureIds]; ok {
+		i.Data.FeatureIds = DecodeInstanceFeatureIds(cd.data)
+	}
+	if cd, ok := chunkMap[i.SymbologyOverrides]; ok {
+		i.Data.SymbologyOverrides = DecodeInstanceOverrides(cd.data)
+	}
+}
+
+func (i *Instances) encodeData(nextBufferName func() string) []chunkData {
+	var chunks []chunkData
+
+	i.Count = uint32(len(i.Data.Transforms))
+	if len(i.TransformCenter) != 3 {
+		i.TransformCenter = []float32{0, 0, 0}
+	}
+
+	if i.Transforms == "" {
+		i.Transforms = nextBufferName()
+	}
+	chunks = append(chunks, chunkData{name: i.Transforms, data: EncodeInstanceTransforms(i.Data.Transforms)})
+
+	if len(i.Data.FeatureIds) > 0 {
+		if i.FeatureIds == "" {
+			i.FeatureIds = nextBufferName()
+		}
+		chunks = append(chunks, chunkData{name: i.FeatureIds, data: EncodeInstanceFeatureIds(i.Data.FeatureIds)})
+	} else {
+		i.FeatureIds = ""
+	}
+
+	if len(i.Data.SymbologyOverrides) > 0 {
+		if i.SymbologyOverrides == "" {
+			i.SymbologyOverrides = nextBufferName()
+		}
+		chunks = append(chunks, chunkData{name: i.SymbologyOverrides, data: EncodeInstanceOverrides(i.Data.SymbologyOverrides)})
+	} else {
+		i.SymbologyOverrides = ""
+	}
+
+	return chunks
+}
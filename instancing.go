@@ -0,0 +1,352 @@
+package imdl
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image/color"
+	"math"
+	"reflect"
+)
+
+const (
+	defaultInstanceTolerance = 1e-4
+	instanceNormalTolerance  = 1e-2
+	instanceUvTolerance      = 1e-4
+)
+
+type InstancingOptions struct {
+	// Tolerance is the largest distance allowed between a vertex and the
+	// transformed vertex of the primitive it is matched against.
+	Tolerance float32
+	// MinInstanceCount is the smallest number of congruent primitives that
+	// are folded into one instanced primitive.
+	MinInstanceCount int
+}
+
+type vec3 [3]float64
+
+func toVec3(p [3]float32) vec3 {
+	return vec3{float64(p[0]), float64(p[1]), float64(p[2])}
+}
+
+func (a vec3) sub(b vec3) vec3 {
+	return vec3{a[0] - b[0], a[1] - b[1], a[2] - b[2]}
+}
+
+func (a vec3) add(b vec3) vec3 {
+	return vec3{a[0] + b[0], a[1] + b[1], a[2] + b[2]}
+}
+
+func (a vec3) scale(s float64) vec3 {
+	return vec3{a[0] * s, a[1] * s, a[2] * s}
+}
+
+func (a vec3) dot(b vec3) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func (a vec3) cross(b vec3) vec3 {
+	return vec3{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+func (a vec3) length() float64 {
+	return math.Sqrt(a.dot(a))
+}
+
+// rigidTransform maps p to rotation*p + translation.
+type rigidTransform struct {
+	rotation    [3]vec3
+	translation vec3
+}
+
+func (t *rigidTransform) rotate(p vec3) vec3 {
+	return vec3{t.rotation[0].dot(p), t.rotation[1].dot(p), t.rotation[2].dot(p)}
+}
+
+func (t *rigidTransform) apply(p vec3) vec3 {
+	return t.rotate(p).add(t.translation)
+}
+
+type instanceFrame struct {
+	origin, a, b int
+}
+
+// findInstanceFrame picks three vertices that span a plane, used to derive
+// the rotation between congruent primitives.
+func findInstanceFrame(pos []vec3) *instanceFrame {
+	if len(pos) < 3 {
+		return nil
+	}
+	f := &instanceFrame{}
+	maxDist := 0.0
+	for i := range pos {
+		if d := pos[i].sub(pos[0]).length(); d > maxDist {
+			maxDist = d
+			f.a = i
+		}
+	}
+	if maxDist == 0 {
+		return nil
+	}
+	axis := pos[f.a].sub(pos[0])
+	maxArea := 0.0
+	for i := range pos {
+		if area := axis.cross(pos[i].sub(pos[0])).length(); area > maxArea {
+			maxArea = area
+			f.b = i
+		}
+	}
+	if maxArea < 1e-9*maxDist*maxDist {
+		return nil
+	}
+	return f
+}
+
+func (f *instanceFrame) axes(pos []vec3) [3]vec3 {
+	x := pos[f.a].sub(pos[f.origin])
+	x = x.scale(1 / x.length())
+	z := x.cross(pos[f.b].sub(pos[f.origin]))
+	z = z.scale(1 / z.length())
+	return [3]vec3{x, z.cross(x), z}
+}
+
+func (f *instanceFrame) transform(from, to []vec3) *rigidTransform {
+	fa := f.axes(from)
+	ta := f.axes(to)
+	t := &rigidTransform{}
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			t.rotation[r][c] = ta[0][r]*fa[0][c] + ta[1][r]*fa[1][c] + ta[2][r]*fa[2][c]
+		}
+	}
+	t.translation = to[f.origin].sub(t.rotate(from[f.origin]))
+	return t
+}
+
+type instanceCandidate struct {
+	index     int
+	prim      *MeshPrimitive
+	pos       []vec3
+	colors    []color.NRGBA
+	featureId *uint32
+	frame     *instanceFrame
+	transform *rigidTransform
+}
+
+func newInstanceCandidate(index int, item PrimitiveItem) *instanceCandidate {
+	p, ok := item.(*MeshPrimitive)
+	if !ok || p.Data == nil || p.Instances != nil || p.AuxChannels != nil || p.AreaPattern != nil || p.ViewIndependentOrigin != nil {
+		return nil
+	}
+
+	c := &instanceCandidate{index: index, prim: p, pos: make([]vec3, len(p.Data.Vertexs)), colors: make([]color.NRGBA, len(p.Data.Vertexs))}
+	for i := range p.Data.Vertexs {
+		v := &p.Data.Vertexs[i]
+		c.pos[i] = toVec3(v.Pos)
+		switch {
+		case v.Color != nil:
+			c.colors[i] = *v.Color
+		case p.Vertices.ColorTable != nil && v.ColorIndex != nil:
+			c.colors[i] = p.Vertices.ColorTable.GetColor(*v.ColorIndex)
+		case p.Vertices.ColorTable != nil:
+			c.colors[i] = p.Vertices.ColorTable.GetColor(0)
+		}
+	}
+
+	switch {
+	case p.Vertices.FeatureIndexType == Uniform && p.Vertices.FeatureId != nil:
+		id := *p.Vertices.FeatureId
+		c.featureId = &id
+	case p.Vertices.FeatureIndexType != Empty:
+		for i := range p.Data.Vertexs {
+			fi := p.Data.Vertexs[i].FeatureIndex
+			if fi == nil || (c.featureId != nil && *fi != *c.featureId) {
+				return nil
+			}
+			c.featureId = fi
+		}
+	}
+
+	if c.frame = findInstanceFrame(c.pos); c.frame == nil {
+		return nil
+	}
+	return c
+}
+
+func (c *instanceCandidate) key() string {
+	h := fnv.New64a()
+	for _, i := range c.prim.Data.Indices {
+		h.Write([]byte{byte(i), byte(i >> 8), byte(i >> 16), byte(i >> 24)})
+	}
+	return fmt.Sprintf("%s/%d/%d/%d/%v/%x", c.prim.Material, c.prim.Surface.Type, len(c.pos), len(c.prim.Data.Indices), c.featureId != nil, h.Sum64())
+}
+
+func (c *instanceCandidate) matches(ref *instanceCandidate, tolerance float64) *rigidTransform {
+	a, b := ref.prim.Data, c.prim.Data
+	if !reflect.DeepEqual(a.Indices, b.Indices) || !reflect.DeepEqual(a.Materials, b.Materials) || !reflect.DeepEqual(ref.prim.EdgeData, c.prim.EdgeData) {
+		return nil
+	}
+
+	t := ref.frame.transform(ref.pos, c.pos)
+	for i := range ref.pos {
+		if t.apply(ref.pos[i]).sub(c.pos[i]).length() > tolerance || ref.colors[i] != c.colors[i] {
+			return nil
+		}
+
+		va, vb := &a.Vertexs[i], &b.Vertexs[i]
+		if (va.MaterialIndex == nil) != (vb.MaterialIndex == nil) || (va.MaterialIndex != nil && *va.MaterialIndex != *vb.MaterialIndex) {
+			return nil
+		}
+		if (va.UV == nil) != (vb.UV == nil) || (va.UV != nil && (math.Abs(float64(va.UV[0]-vb.UV[0])) > instanceUvTolerance || math.Abs(float64(va.UV[1]-vb.UV[1])) > instanceUvTolerance)) {
+			return nil
+		}
+		if (va.Normal == nil) != (vb.Normal == nil) {
+			return nil
+		}
+		if va.Normal != nil && t.rotate(toVec3(*va.Normal)).sub(toVec3(*vb.Normal)).length() > instanceNormalTolerance {
+			return nil
+		}
+	}
+	return t
+}
+
+// foldInstances replaces the congruent primitives with one instanced
+// primitive whose geometry is the first primitive centered on its centroid.
+func foldInstances(group []*instanceCandidate) *MeshPrimitive {
+	ref := group[0]
+
+	var centroid vec3
+	for _, p := range ref.pos {
+		centroid = centroid.add(p)
+	}
+	centroid = centroid.scale(1 / float64(len(ref.pos)))
+
+	offsets := make([]vec3, len(group))
+	var center vec3
+	for i, c := range group {
+		offsets[i] = c.transform.apply(centroid)
+		center = center.add(offsets[i])
+	}
+	center = center.scale(1 / float64(len(group)))
+
+	data := &InstanceData{Transforms: make([][12]float32, len(group))}
+	for i, c := range group {
+		t := offsets[i].sub(center)
+		for r := 0; r < 3; r++ {
+			m := data.Transforms[i][r*4 : r*4+4]
+			m[0] = float32(c.transform.rotation[r][0])
+			m[1] = float32(c.transform.rotation[r][1])
+			m[2] = float32(c.transform.rotation[r][2])
+			m[3] = float32(t[r])
+		}
+		if c.featureId != nil {
+			data.FeatureIds = append(data.FeatureIds, *c.featureId)
+		}
+	}
+
+	prim := *ref.prim
+	prim.Members = nil
+	prim.digest = nil
+	prim.Surface.Indices = ""
+	prim.Edges = nil
+	prim.Vertices.BufferView = ""
+	prim.Vertices.FeatureIndexType = Empty
+	prim.Vertices.FeatureId = nil
+	if ref.prim.Vertices.MaterialAtlas != nil {
+		atlas := *ref.prim.Vertices.MaterialAtlas
+		prim.Vertices.MaterialAtlas = &atlas
+	}
+	prim.Instances = &Instances{TransformCenter: []float32{float32(center[0]), float32(center[1]), float32(center[2])}, Data: data}
+
+	prim.Data = &MeshData{Type: ref.prim.Data.Type, Indices: ref.prim.Data.Indices, Materials: ref.prim.Data.Materials}
+	prim.Data.Vertexs = make([]MeshVertex, len(ref.prim.Data.Vertexs))
+	for i := range prim.Data.Vertexs {
+		v := ref.prim.Data.Vertexs[i]
+		p := ref.pos[i].sub(centroid)
+		v.Pos = [3]float32{float32(p[0]), float32(p[1]), float32(p[2])}
+		v.FeatureIndex = nil
+		prim.Data.Vertexs[i] = v
+	}
+	return &prim
+}
+
+func instancePrimitives(items []PrimitiveItem, opts InstancingOptions) ([]PrimitiveItem, int) {
+	groups := make(map[string][][]*instanceCandidate)
+	var keys []string
+	for i, item := range items {
+		c := newInstanceCandidate(i, item)
+		if c == nil {
+			continue
+		}
+		key := c.key()
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		matched := false
+		for j, group := range groups[key] {
+			if t := c.matches(group[0], float64(opts.Tolerance)); t != nil {
+				c.transform = t
+				groups[key][j] = append(group, c)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			c.transform = &rigidTransform{rotation: [3]vec3{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}}
+			groups[key] = append(groups[key], []*instanceCandidate{c})
+		}
+	}
+
+	replaced := make(map[int]PrimitiveItem)
+	removed := make(map[int]bool)
+	count := 0
+	for _, key := range keys {
+		for _, group := range groups[key] {
+			if len(group) < opts.MinInstanceCount {
+				continue
+			}
+			replaced[group[0].index] = foldInstances(group)
+			for _, c := range group[1:] {
+				removed[c.index] = true
+			}
+			count++
+		}
+	}
+	if count == 0 {
+		return items, 0
+	}
+
+	result := make([]PrimitiveItem, 0, len(items)-len(removed))
+	for i, item := range items {
+		if removed[i] {
+			continue
+		}
+		if p, ok := replaced[i]; ok {
+			item = p
+		}
+		result = append(result, item)
+	}
+	return result, count
+}
+
+// CreateInstances folds mesh primitives that are congruent up to a rigid
+// transform and share a material into instanced primitives. It returns the
+// number of instanced primitives created.
+func (doc *Document) CreateInstances(opts InstancingOptions) int {
+	if opts.Tolerance <= 0 {
+		opts.Tolerance = defaultInstanceTolerance
+	}
+	if opts.MinInstanceCount < 2 {
+		opts.MinInstanceCount = 2
+	}
+
+	count := 0
+	for _, k := range sortedKeys(doc.Meshes) {
+		m := doc.Meshes[k]
+		var n int
+		m.Primitives, n = instancePrimitives(m.Primitives, opts)
+		count += n
+	}
+	return count
+}
@@ -0,0 +1,106 @@
+package imdl
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+const numRgbaPerAtlasMaterial = 4
+
+const (
+	atlasMaterialHasRgb   = 1 << 0
+	atlasMaterialHasAlpha = 1 << 1
+)
+
+type AtlasMaterial struct {
+	DiffuseColor     *[3]float32
+	Transparency     *float32
+	Diffuse          float32
+	Specular         float32
+	SpecularColor    [3]float32
+	SpecularExponent float32
+}
+
+func unitToByte(val float32) uint8 {
+	return uint8(math.Floor(float64(clamp(val, 0, 1))*255.0 + 0.5))
+}
+
+func byteToUnit(val uint8) float32 {
+	return float32(val) / 255.0
+}
+
+/**
+ *  Each material of the atlas consists of 4 RGBA:
+ *  diffuse rgb + alpha         00
+ *  unused, diffuse weight,
+ *  specular weight, flags      04
+ *  specular rgb + unused       08
+ *  specular exponent (float)   12
+ */
+func DecodeMaterialAtlas(data []byte, numMaterials uint32) []AtlasMaterial {
+	if len(data) < int(numMaterials)*numRgbaPerAtlasMaterial*4 {
+		return nil
+	}
+	materials := make([]AtlasMaterial, numMaterials)
+	for i := range materials {
+		b := data[i*numRgbaPerAtlasMaterial*4:]
+		m := &materials[i]
+		flags := b[7]
+		if flags&atlasMaterialHasRgb != 0 {
+			m.DiffuseColor = &[3]float32{byteToUnit(b[0]), byteToUnit(b[1]), byteToUnit(b[2])}
+		}
+		if flags&atlasMaterialHasAlpha != 0 {
+			transparency := 1.0 - byteToUnit(b[3])
+			m.Transparency = &transparency
+		}
+		m.Diffuse = byteToUnit(b[5])
+		m.Specular = byteToUnit(b[6])
+		m.SpecularColor = [3]float32{byteToUnit(b[8]), byteToUnit(b[9]), byteToUnit(b[10])}
+		m.SpecularExponent = math.Float32frombits(binary.LittleEndian.Uint32(b[12:]))
+	}
+	return materials
+}
+
+func EncodeMaterialAtlas(materials []AtlasMaterial) []byte {
+	data := make([]byte, len(materials)*numRgbaPerAtlasMaterial*4)
+	for i := range materials {
+		b := data[i*numRgbaPerAtlasMaterial*4:]
+		m := &materials[i]
+		flags := uint8(0)
+		b[3] = 255
+		if m.DiffuseColor != nil {
+			flags |= atlasMaterialHasRgb
+			b[0] = unitToByte(m.DiffuseColor[0])
+			b[1] = unitToByte(m.DiffuseColor[1])
+			b[2] = unitToByte(m.DiffuseColor[2])
+		}
+		if m.Transparency != nil {
+			flags |= atlasMaterialHasAlpha
+			b[3] = unitToByte(1.0 - *m.Transparency)
+		}
+		b[5] = unitToByte(m.Diffuse)
+		b[6] = unitToByte(m.Specular)
+		b[7] = flags
+		b[8] = unitToByte(m.SpecularColor[0])
+		b[9] = unitToByte(m.SpecularColor[1])
+		b[10] = unitToByte(m.SpecularColor[2])
+		binary.LittleEndian.PutUint32(b[12:], math.Float32bits(m.SpecularExponent))
+	}
+	return data
+}
+
+func (a *MaterialAtlas) update(materials []AtlasMaterial) {
+	hasTranslucency := false
+	overridesAlpha := false
+	for i := range materials {
+		if materials[i].Transparency != nil {
+			overridesAlpha = true
+			if *materials[i].Transparency > 0 {
+				hasTranslucency = true
+			}
+		}
+	}
+	a.NumMaterials = uint32(len(materials))
+	a.HasTranslucency = &hasTranslucency
+	a.OverridesAlpha = &overridesAlpha
+}
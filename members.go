@@ -0,0 +1,136 @@
+package imdl
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Members keeps the JSON members of an object that have no matching field,
+// so that they are written back unchanged.
+type Members map[string]json.RawMessage
+
+var knownMembersCache sync.Map
+
+func knownMembers(t reflect.Type) map[string]bool {
+	if m, ok := knownMembersCache.Load(t); ok {
+		return m.(map[string]bool)
+	}
+	m := make(map[string]bool)
+	collectKnownMembers(t, m)
+	knownMembersCache.Store(t, m)
+	return m
+}
+
+func collectKnownMembers(t reflect.Type, m map[string]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				collectKnownMembers(ft, m)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		m[name] = true
+	}
+}
+
+// unmarshalMembers decodes data into v, which must be a pointer to a struct
+// without its own UnmarshalJSON, and returns the members v has no field for.
+func unmarshalMembers(data []byte, v interface{}) (Members, error) {
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	known := knownMembers(reflect.TypeOf(v).Elem())
+	var members Members
+	for k, raw := range all {
+		if known[k] {
+			continue
+		}
+		if members == nil {
+			members = make(Members)
+		}
+		members[k] = raw
+	}
+	return members, nil
+}
+
+// marshalMembers encodes v and appends the unknown members in key order.
+func marshalMembers(v interface{}, members Members) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || len(members) == 0 {
+		return b, err
+	}
+
+	keys := make([]string, 0, len(members))
+	for k := range members {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := bytes.NewBuffer(b[:len(b)-1])
+	empty := bytes.Equal(bytes.TrimSpace(b), []byte("{}"))
+	for _, k := range keys {
+		if !empty {
+			buf.WriteByte(',')
+		}
+		empty = false
+		name, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(members[k])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func appendMissing(list []string, names ...string) []string {
+	for _, name := range names {
+		found := false
+		for _, s := range list {
+			if s == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+func removeAll(list []string, name string) []string {
+	var out []string
+	for _, s := range list {
+		if s != name {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,343 @@
+package imdl
+
+import (
+	"bufio"
+	"fmt"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// objName replaces the white space OBJ and MTL statements can't hold.
+func objName(name string) string {
+	return strings.Join(strings.Fields(name), "_")
+}
+
+func textureExt(format TextureFormat) string {
+	if format == FormatPNG {
+		return ".png"
+	}
+	return ".jpg"
+}
+
+type objExporter struct {
+	doc *Document
+	obj *bufio.Writer
+	mtl *bufio.Writer
+	// materials maps a material and uniform color to its MTL name.
+	materials map[string]string
+	// names counts the MTL entries written per material name.
+	names map[string]int
+	// textures maps a texture name to its image file name.
+	textures map[string]string
+	images   map[string][]byte
+	// vertexCount, uvCount and normalCount are the numbers of v, vt and vn
+	// statements written, OBJ indices being global and 1-based.
+	vertexCount int
+	uvCount     int
+	normalCount int
+}
+
+func (e *objExporter) texture(name string) (string, error) {
+	if file, ok := e.textures[name]; ok {
+		return file, nil
+	}
+	data, format, err := e.doc.textureImage(name)
+	if err != nil {
+		return "", fmt.Errorf("imdl: exporting texture %q: %w", name, err)
+	}
+	var file string
+	if data != nil {
+		file = objName(name) + textureExt(format)
+		e.images[file] = data
+	}
+	e.textures[name] = file
+	return file, nil
+}
+
+// material writes the MTL entry of an imdl material. As OBJ has no vertex
+// colors, a uniform vertex color becomes the diffuse color, so an entry is
+// written per distinct color.
+func (e *objExporter) material(name string, uniform *color.NRGBA, textured bool, lit bool) (string, error) {
+	key := fmt.Sprintf("%s/%v/%v/%v", name, uniform, textured, lit)
+	if mtlName, ok := e.materials[key]; ok {
+		return mtlName, nil
+	}
+
+	mtlName := objName(name)
+	if mtlName == "" {
+		mtlName = "MaterialDefault"
+	}
+	if n := e.names[mtlName]; n > 0 {
+		e.names[mtlName]++
+		mtlName = fmt.Sprintf("%s_%d", mtlName, n)
+	} else {
+		e.names[mtlName] = 1
+	}
+	e.materials[key] = mtlName
+
+	diffuse := [3]float32{1, 1, 1}
+	if uniform != nil {
+		diffuse = [3]float32{float32(uniform.R) / 255, float32(uniform.G) / 255, float32(uniform.B) / 255}
+	}
+	var specular [3]float32
+	exponent := float32(0)
+	alpha := float32(1)
+	if uniform != nil {
+		alpha = float32(uniform.A) / 255
+	}
+
+	var textureName string
+	if mat, ok := e.doc.Materials[name]; ok {
+		if mat.Texture != nil {
+			textureName = mat.Texture.Name
+		}
+		if rm, ok := e.doc.RenderMaterials[mat.MaterialId]; ok {
+			if rm.DiffuseColor != nil {
+				diffuse = *rm.DiffuseColor
+			}
+			for i := range diffuse {
+				diffuse[i] *= rm.Diffuse
+			}
+			if rm.SpecularColor != nil {
+				specular = *rm.SpecularColor
+			}
+			for i := range specular {
+				specular[i] *= rm.Specular
+			}
+			exponent = rm.SpecularExponent
+			if rm.Transparency != nil {
+				alpha *= 1 - *rm.Transparency
+			}
+			if textureName == "" && rm.TextureMapping != nil {
+				textureName = rm.TextureMapping.Texture.Name
+			}
+		}
+	}
+
+	illum := 0
+	if lit {
+		illum = 2
+	}
+	fmt.Fprintf(e.mtl, "newmtl %s\n", mtlName)
+	fmt.Fprintf(e.mtl, "Kd %g %g %g\n", diffuse[0], diffuse[1], diffuse[2])
+	fmt.Fprintf(e.mtl, "Ks %g %g %g\n", specular[0], specular[1], specular[2])
+	fmt.Fprintf(e.mtl, "Ns %g\n", exponent)
+	fmt.Fprintf(e.mtl, "d %g\n", alpha)
+	fmt.Fprintf(e.mtl, "illum %d\n", illum)
+	if textured && textureName != "" {
+		file, err := e.texture(textureName)
+		if err != nil {
+			return "", err
+		}
+		if file != "" {
+			fmt.Fprintf(e.mtl, "map_Kd %s\n", file)
+		}
+	}
+	fmt.Fprintln(e.mtl)
+	return mtlName, nil
+}
+
+// uniformColor returns the color shared by all vertices, nil when they vary.
+func uniformColor(table *VertexTable, vertexs []*SimpleVertex) *color.NRGBA {
+	if len(vertexs) == 0 {
+		return nil
+	}
+	c := table.vertexColor(vertexs[0])
+	for _, v := range vertexs[1:] {
+		if table.vertexColor(v) != c {
+			return nil
+		}
+	}
+	return &c
+}
+
+func (e *objExporter) group(meshKey string, material string, table *VertexTable, vertexs []*SimpleVertex, textured bool, lit bool) error {
+	mtlName, err := e.material(material, uniformColor(table, vertexs), textured, lit)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(e.obj, "g %s\n", objName(meshKey+"_"+mtlName))
+	fmt.Fprintf(e.obj, "usemtl %s\n", mtlName)
+	for _, v := range vertexs {
+		fmt.Fprintf(e.obj, "v %g %g %g\n", v.Pos[0], v.Pos[1], v.Pos[2])
+	}
+	return nil
+}
+
+func (e *objExporter) meshPrimitive(meshKey string, p *MeshPrimitive, d *MeshData, table *VertexTable) error {
+	lit := d.Type == ST_Lit || d.Type == ST_TexturedLit
+	textured := d.Type == ST_Textured || d.Type == ST_TexturedLit
+	if mat, ok := e.doc.Materials[p.Material]; ok && mat.IgnoreLighting != nil && *mat.IgnoreLighting {
+		lit = false
+	}
+	var normals [][3]float32
+	if lit {
+		if normals = meshNormals(d); normals == nil {
+			lit = false
+		}
+	}
+	if textured {
+		for i := range d.Vertexs {
+			if d.Vertexs[i].UV == nil {
+				textured = false
+				break
+			}
+		}
+	}
+
+	if err := e.group(meshKey, p.Material, table, d.simpleVertexs(), textured, lit); err != nil {
+		return err
+	}
+	if textured {
+		// OBJ texture coordinates start at the bottom of the image.
+		for i := range d.Vertexs {
+			fmt.Fprintf(e.obj, "vt %g %g\n", d.Vertexs[i].UV[0], 1-d.Vertexs[i].UV[1])
+		}
+	}
+	for _, n := range normals {
+		fmt.Fprintf(e.obj, "vn %g %g %g\n", n[0], n[1], n[2])
+	}
+
+	index := func(i uint32) string {
+		v := fmt.Sprint(e.vertexCount + int(i) + 1)
+		switch {
+		case textured && lit:
+			return fmt.Sprintf("%s/%d/%d", v, e.uvCount+int(i)+1, e.normalCount+int(i)+1)
+		case textured:
+			return fmt.Sprintf("%s/%d", v, e.uvCount+int(i)+1)
+		case lit:
+			return fmt.Sprintf("%s//%d", v, e.normalCount+int(i)+1)
+		}
+		return v
+	}
+	for i := 0; i+2 < len(d.Indices); i += 3 {
+		fmt.Fprintf(e.obj, "f %s %s %s\n", index(d.Indices[i]), index(d.Indices[i+1]), index(d.Indices[i+2]))
+	}
+
+	e.vertexCount += len(d.Vertexs)
+	if textured {
+		e.uvCount += len(d.Vertexs)
+	}
+	e.normalCount += len(normals)
+	return nil
+}
+
+func (e *objExporter) elements(statement string, lines [][]uint32) {
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		e.obj.WriteString(statement)
+		for _, i := range line {
+			fmt.Fprintf(e.obj, " %d", e.vertexCount+int(i)+1)
+		}
+		e.obj.WriteString("\n")
+	}
+}
+
+func (e *objExporter) primitive(meshKey string, item PrimitiveItem) error {
+	switch p := item.(type) {
+	case *MeshPrimitive:
+		if p.Data == nil || len(p.Data.Indices) == 0 {
+			return nil
+		}
+		d, table := worldMeshData(p)
+		return e.meshPrimitive(meshKey, p, d, table)
+	case *PolylinePrimitive:
+		if p.Data == nil {
+			return nil
+		}
+		d, table := worldPolylineData(p)
+		lines := d.LineStrings()
+		if len(lines) == 0 {
+			return nil
+		}
+		if err := e.group(meshKey, p.Material, table, d.simpleVertexs(), false, false); err != nil {
+			return err
+		}
+		e.elements("l", lines)
+		e.vertexCount += len(d.Vertexs)
+	case *PointStringPrimitive:
+		if p.Data == nil || len(p.Data.Indices) == 0 {
+			return nil
+		}
+		d, table := worldPointStringData(p)
+		if err := e.group(meshKey, p.Material, table, d.simpleVertexs(), false, false); err != nil {
+			return err
+		}
+		e.elements("p", [][]uint32{d.Indices})
+		e.vertexCount += len(d.Vertexs)
+	}
+	return nil
+}
+
+// ExportObj writes the mesh, polyline and point string primitives of a
+// document as Wavefront OBJ, with their materials in MTL referenced as
+// mtlLib. Each primitive becomes a group named after its mesh key and
+// material; instances are expanded. Positions stay in tile coordinates, z
+// up. The texture images the MTL refers to are returned by file name.
+func ExportObj(doc *Document, obj io.Writer, mtl io.Writer, mtlLib string) (map[string][]byte, error) {
+	e := &objExporter{
+		doc:       doc,
+		obj:       bufio.NewWriter(obj),
+		mtl:       bufio.NewWriter(mtl),
+		materials: make(map[string]string),
+		names:     make(map[string]int),
+		textures:  make(map[string]string),
+		images:    make(map[string][]byte),
+	}
+	fmt.Fprintln(e.obj, "# flywave/go-imdl")
+	if mtlLib != "" {
+		fmt.Fprintf(e.obj, "mtllib %s\n", mtlLib)
+	}
+	for _, k := range sortedKeys(doc.Meshes) {
+		for i, item := range doc.Meshes[k].Primitives {
+			if err := e.primitive(k, item); err != nil {
+				return nil, fmt.Errorf("imdl: exporting primitive %d of %q: %w", i, k, err)
+			}
+		}
+	}
+	if err := e.obj.Flush(); err != nil {
+		return nil, err
+	}
+	if err := e.mtl.Flush(); err != nil {
+		return nil, err
+	}
+	return e.images, nil
+}
+
+// SaveObj writes a document to the OBJ file name, its MTL file next to it
+// with the same base name, and the texture images into the same directory.
+func SaveObj(doc *Document, name string) error {
+	dir := filepath.Dir(name)
+	mtlLib := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)) + ".mtl"
+
+	obj, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	mtl, err := os.Create(filepath.Join(dir, mtlLib))
+	if err != nil {
+		return err
+	}
+	defer mtl.Close()
+
+	images, err := ExportObj(doc, obj, mtl, mtlLib)
+	if err != nil {
+		return err
+	}
+	for _, file := range sortedKeys(images) {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), images[file], 0644); err != nil {
+			return err
+		}
+	}
+	if err := mtl.Close(); err != nil {
+		return err
+	}
+	return obj.Close()
+}
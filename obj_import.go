@@ -0,0 +1,601 @@
+package imdl
+
+import (
+	"bufio"
+	"fmt"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// objIndex refers to the v, vt and vn of a face corner, -1 when absent.
+type objIndex struct {
+	v, vt, vn int
+}
+
+type objGroup struct {
+	material  string
+	triangles []objIndex
+	lines     [][]objIndex
+	points    []objIndex
+}
+
+type objMaterial struct {
+	diffuse  [3]float32
+	specular [3]float32
+	exponent float32
+	alpha    float32
+	illum    int
+	texture  string
+	// name is the imdl material the MTL entry was converted to.
+	name string
+}
+
+func newObjMaterial() *objMaterial {
+	return &objMaterial{diffuse: [3]float32{1, 1, 1}, exponent: 13.5, alpha: 1, illum: 2}
+}
+
+type objImporter struct {
+	doc       *Document
+	dir       string
+	positions [][3]float32
+	colors    []*color.NRGBA
+	uvs       [][2]float32
+	normals   [][3]float32
+	mtls      map[string]*objMaterial
+	groups    []*objGroup
+	// current maps a group and material name to their primitive group.
+	current  map[string]*objGroup
+	group    string
+	material string
+	textures map[string]string
+}
+
+func parseFloats(fields []string, n int) ([]float32, error) {
+	if len(fields) < n {
+		return nil, fmt.Errorf("expected %d values", n)
+	}
+	values := make([]float32, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(f, 32)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = float32(v)
+	}
+	return values, nil
+}
+
+// resolveObjIndex turns a 1-based or negative relative OBJ index into a
+// 0-based one.
+func resolveObjIndex(s string, count int) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case i > 0 && i <= count:
+		return i - 1, nil
+	case i < 0 && -i <= count:
+		return count + i, nil
+	}
+	return 0, fmt.Errorf("index %d is out of range", i)
+}
+
+func (im *objImporter) corner(s string) (objIndex, error) {
+	r := objIndex{v: -1, vt: -1, vn: -1}
+	parts := strings.Split(s, "/")
+	var err error
+	if r.v, err = resolveObjIndex(parts[0], len(im.positions)); err != nil {
+		return r, err
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		if r.vt, err = resolveObjIndex(parts[1], len(im.uvs)); err != nil {
+			return r, err
+		}
+	}
+	if len(parts) > 2 && parts[2] != "" {
+		if r.vn, err = resolveObjIndex(parts[2], len(im.normals)); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+func (im *objImporter) corners(fields []string) ([]objIndex, error) {
+	corners := make([]objIndex, len(fields))
+	for i, f := range fields {
+		c, err := im.corner(f)
+		if err != nil {
+			return nil, err
+		}
+		corners[i] = c
+	}
+	return corners, nil
+}
+
+func (im *objImporter) currentGroup() *objGroup {
+	key := im.group + "\x00" + im.material
+	g, ok := im.current[key]
+	if !ok {
+		g = &objGroup{material: im.material}
+		im.current[key] = g
+		im.groups = append(im.groups, g)
+	}
+	return g
+}
+
+// triangulatePolygon ear clips a planar polygon and returns the corners of
+// the triangles. Polygons it can't clip, such as self-intersecting ones,
+// are fanned.
+func triangulatePolygon(pos []vec3) [][3]int {
+	n := len(pos)
+	if n < 3 {
+		return nil
+	}
+	if n == 3 {
+		return [][3]int{{0, 1, 2}}
+	}
+
+	var normal vec3
+	for i := range pos {
+		a, b := pos[i], pos[(i+1)%n]
+		normal[0] += (a[1] - b[1]) * (a[2] + b[2])
+		normal[1] += (a[2] - b[2]) * (a[0] + b[0])
+		normal[2] += (a[0] - b[0]) * (a[1] + b[1])
+	}
+	k := 2
+	if math.Abs(normal[0]) > math.Abs(normal[k]) {
+		k = 0
+	}
+	if math.Abs(normal[1]) > math.Abs(normal[k]) {
+		k = 1
+	}
+	// Dropping the dominant axis keeps the polygon counter-clockwise in the
+	// plane of the other two.
+	ax, ay := (k+1)%3, (k+2)%3
+	if normal[k] < 0 {
+		ax, ay = ay, ax
+	}
+	cross := func(a, b, c int) float64 {
+		return (pos[b][ax]-pos[a][ax])*(pos[c][ay]-pos[a][ay]) - (pos[b][ay]-pos[a][ay])*(pos[c][ax]-pos[a][ax])
+	}
+
+	var triangles [][3]int
+	remaining := make([]int, n)
+	for i := range remaining {
+		remaining[i] = i
+	}
+	for len(remaining) > 3 {
+		m := len(remaining)
+		ear := -1
+		for i := 0; i < m && ear < 0; i++ {
+			a, b, c := remaining[(i+m-1)%m], remaining[i], remaining[(i+1)%m]
+			if cross(a, b, c) <= 0 {
+				continue
+			}
+			ear = i
+			for _, j := range remaining {
+				if j != a && j != b && j != c && cross(a, b, j) >= 0 && cross(b, c, j) >= 0 && cross(c, a, j) >= 0 {
+					ear = -1
+					break
+				}
+			}
+		}
+		if ear < 0 {
+			for i := 1; i+1 < m; i++ {
+				triangles = append(triangles, [3]int{remaining[0], remaining[i], remaining[i+1]})
+			}
+			return triangles
+		}
+		triangles = append(triangles, [3]int{remaining[(ear+m-1)%m], remaining[ear], remaining[(ear+1)%m]})
+		remaining = append(remaining[:ear], remaining[ear+1:]...)
+	}
+	return append(triangles, [3]int{remaining[0], remaining[1], remaining[2]})
+}
+
+func (im *objImporter) face(corners []objIndex) {
+	pos := make([]vec3, len(corners))
+	for i, c := range corners {
+		pos[i] = toVec3(im.positions[c.v])
+	}
+	g := im.currentGroup()
+	for _, t := range triangulatePolygon(pos) {
+		g.triangles = append(g.triangles, corners[t[0]], corners[t[1]], corners[t[2]])
+	}
+}
+
+func (im *objImporter) statement(keyword string, fields []string) error {
+	switch keyword {
+	case "v":
+		values, err := parseFloats(fields, 3)
+		if err != nil {
+			return err
+		}
+		im.positions = append(im.positions, [3]float32{values[0], values[1], values[2]})
+		// Vertex colors are a common extension of the v statement.
+		var c *color.NRGBA
+		if len(values) >= 6 {
+			c = &color.NRGBA{R: unitToByte(values[3]), G: unitToByte(values[4]), B: unitToByte(values[5]), A: 255}
+		}
+		im.colors = append(im.colors, c)
+	case "vt":
+		values, err := parseFloats(fields, 1)
+		if err != nil {
+			return err
+		}
+		uv := [2]float32{values[0], 1}
+		if len(values) > 1 {
+			uv[1] = 1 - values[1]
+		}
+		im.uvs = append(im.uvs, uv)
+	case "vn":
+		values, err := parseFloats(fields, 3)
+		if err != nil {
+			return err
+		}
+		im.normals = append(im.normals, normalizeVector([3]float32{values[0], values[1], values[2]}))
+	case "f":
+		corners, err := im.corners(fields)
+		if err != nil {
+			return err
+		}
+		if len(corners) < 3 {
+			return fmt.Errorf("face with %d corners", len(corners))
+		}
+		im.face(corners)
+	case "l":
+		corners, err := im.corners(fields)
+		if err != nil {
+			return err
+		}
+		if len(corners) >= 2 {
+			g := im.currentGroup()
+			g.lines = append(g.lines, corners)
+		}
+	case "p":
+		corners, err := im.corners(fields)
+		if err != nil {
+			return err
+		}
+		g := im.currentGroup()
+		g.points = append(g.points, corners...)
+	case "g", "o":
+		im.group = strings.Join(fields, " ")
+	case "usemtl":
+		im.material = strings.Join(fields, " ")
+	case "mtllib":
+		for _, name := range fields {
+			if err := im.mtllib(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scanObj calls fn with the keyword and arguments of every statement of an
+// OBJ or MTL file.
+func scanObj(r io.Reader, fn func(keyword string, fields []string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	var pending string
+	for scanner.Scan() {
+		line++
+		text := pending + scanner.Text()
+		if strings.HasSuffix(text, "\\") {
+			pending = strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		pending = ""
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := fn(fields[0], fields[1:]); err != nil {
+			return fmt.Errorf("imdl: line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// mtllib reads the materials of an MTL file. Files that can't be found are
+// skipped, leaving their materials white.
+func (im *objImporter) mtllib(name string) error {
+	if im.dir == "" {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(im.dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var mtl *objMaterial
+	return scanObj(f, func(keyword string, fields []string) error {
+		if keyword == "newmtl" {
+			mtl = newObjMaterial()
+			im.mtls[strings.Join(fields, " ")] = mtl
+			return nil
+		}
+		if mtl == nil {
+			return nil
+		}
+		switch keyword {
+		case "Kd", "Ks":
+			values, err := parseFloats(fields, 3)
+			if err != nil {
+				return err
+			}
+			c := [3]float32{values[0], values[1], values[2]}
+			if keyword == "Kd" {
+				mtl.diffuse = c
+			} else {
+				mtl.specular = c
+			}
+		case "Ns", "d", "Tr", "illum":
+			values, err := parseFloats(fields, 1)
+			if err != nil {
+				return err
+			}
+			switch keyword {
+			case "Ns":
+				mtl.exponent = values[0]
+			case "d":
+				mtl.alpha = values[0]
+			case "Tr":
+				mtl.alpha = 1 - values[0]
+			case "illum":
+				mtl.illum = int(values[0])
+			}
+		case "map_Kd":
+			// Texture options come before the file name.
+			if len(fields) > 0 {
+				mtl.texture = fields[len(fields)-1]
+			}
+		}
+		return nil
+	})
+}
+
+// texture loads an image file into a named texture and returns its name, or
+// "" when the file can't be read or decoded.
+func (im *objImporter) texture(file string) string {
+	if name, ok := im.textures[file]; ok {
+		return name
+	}
+	im.textures[file] = ""
+	data, err := ioutil.ReadFile(filepath.Join(im.dir, filepath.FromSlash(file)))
+	if err != nil {
+		return ""
+	}
+	format, ok := textureFormatOf("", data)
+	if !ok {
+		return ""
+	}
+	decoded := DecodeTexture(data, format)
+	if decoded == nil {
+		return ""
+	}
+
+	name := fmt.Sprintf("Texture%d", len(im.doc.NamedTextures))
+	size := decoded.Bounds().Size()
+	im.doc.NamedTextures[name] = &RenderTexture{Format: uint32(format), Width: uint32(size.X), Height: uint32(size.Y), TextureData: decoded}
+	im.textures[file] = name
+	return name
+}
+
+// materialOf converts the MTL entry used by a group into an imdl material.
+func (im *objImporter) materialOf(name string) (*objMaterial, string) {
+	mtl, ok := im.mtls[name]
+	if !ok {
+		mtl, ok = im.mtls[""]
+		if !ok {
+			mtl = newObjMaterial()
+			mtl.name = "MaterialDefault"
+			im.mtls[""] = mtl
+		}
+	}
+	if _, ok := im.doc.Materials[mtl.name]; ok {
+		return mtl, mtl.name
+	}
+
+	if mtl.name == "" {
+		mtl.name = fmt.Sprintf("Material%d", len(im.doc.Materials))
+	}
+	var texture string
+	if mtl.texture != "" {
+		texture = im.texture(mtl.texture)
+	}
+
+	rm := &RenderMaterial{Diffuse: 1, SpecularExponent: mtl.exponent}
+	diffuse := mtl.diffuse
+	rm.DiffuseColor = &diffuse
+	for _, s := range mtl.specular {
+		rm.Specular = float32(math.Max(float64(rm.Specular), float64(s)))
+	}
+	if rm.Specular > 0 {
+		rm.SpecularColor = &[3]float32{mtl.specular[0] / rm.Specular, mtl.specular[1] / rm.Specular, mtl.specular[2] / rm.Specular}
+	}
+	if mtl.alpha < 1 {
+		transparency := 1 - mtl.alpha
+		rm.Transparency = &transparency
+	}
+	renderMaterialId := fmt.Sprintf("RenderMaterial%d", len(im.doc.RenderMaterials))
+	addImportedMaterial(im.doc, mtl.name, renderMaterialId, rm, mtl.color(), texture, mtl.illum == 0)
+	return mtl, mtl.name
+}
+
+func (m *objMaterial) color() color.NRGBA {
+	return color.NRGBA{R: unitToByte(m.diffuse[0]), G: unitToByte(m.diffuse[1]), B: unitToByte(m.diffuse[2]), A: unitToByte(m.alpha)}
+}
+
+// objVertexs collects the distinct corners of a primitive.
+type objVertexs struct {
+	indices map[objIndex]uint32
+	corners []objIndex
+}
+
+func (v *objVertexs) add(c objIndex) uint32 {
+	if i, ok := v.indices[c]; ok {
+		return i
+	}
+	i := uint32(len(v.corners))
+	v.indices[c] = i
+	v.corners = append(v.corners, c)
+	return i
+}
+
+func (im *objImporter) simpleVertex(c objIndex, mtl *objMaterial) SimpleVertex {
+	col := mtl.color()
+	if im.colors[c.v] != nil {
+		col = *im.colors[c.v]
+		col.A = unitToByte(mtl.alpha)
+	}
+	return SimpleVertex{Pos: im.positions[c.v], Color: &col}
+}
+
+func (im *objImporter) meshPrimitive(g *objGroup) *MeshPrimitive {
+	mtl, name := im.materialOf(g.material)
+	lit := mtl.illum != 0
+	textured := im.doc.Materials[name].Texture != nil
+	for _, c := range g.triangles {
+		lit = lit && c.vn >= 0
+		textured = textured && c.vt >= 0
+	}
+	// Corners only differing by attributes the surface type drops are one
+	// vertex.
+	vertexs := &objVertexs{indices: make(map[objIndex]uint32)}
+	data := &MeshData{Type: ST_Unlit}
+	for _, c := range g.triangles {
+		if !lit {
+			c.vn = -1
+		}
+		if !textured {
+			c.vt = -1
+		}
+		data.Indices = append(data.Indices, vertexs.add(c))
+	}
+	switch {
+	case lit && textured:
+		data.Type = ST_TexturedLit
+	case lit:
+		data.Type = ST_Lit
+	case textured:
+		data.Type = ST_Textured
+	}
+
+	data.Vertexs = make([]MeshVertex, len(vertexs.corners))
+	for i, c := range vertexs.corners {
+		v := &data.Vertexs[i]
+		v.SimpleVertex = im.simpleVertex(c, mtl)
+		if lit {
+			normal := im.normals[c.vn]
+			v.Normal = &normal
+		}
+		if textured {
+			uv := im.uvs[c.vt]
+			v.UV = &uv
+		}
+	}
+
+	prim := &MeshPrimitive{Type: PT_Mesh, Data: data}
+	prim.Material = name
+	prim.Surface.Type = data.Type
+	return prim
+}
+
+func (im *objImporter) polylinePrimitive(g *objGroup) *PolylinePrimitive {
+	mtl, name := im.materialOf(g.material)
+	vertexs := &objVertexs{indices: make(map[objIndex]uint32)}
+	data := &PolylineData{}
+	for _, line := range g.lines {
+		indices := make([]uint32, len(line))
+		for i, c := range line {
+			indices[i] = vertexs.add(objIndex{v: c.v, vt: -1, vn: -1})
+		}
+		data.Lines = append(data.Lines, indices)
+	}
+	data.Vertexs = make([]SimpleVertex, len(vertexs.corners))
+	for i, c := range vertexs.corners {
+		data.Vertexs[i] = im.simpleVertex(c, mtl)
+	}
+	prim := &PolylinePrimitive{Type: PT_Polyline, Data: data}
+	prim.Material = name
+	return prim
+}
+
+func (im *objImporter) pointStringPrimitive(g *objGroup) *PointStringPrimitive {
+	mtl, name := im.materialOf(g.material)
+	vertexs := &objVertexs{indices: make(map[objIndex]uint32)}
+	data := &PointStringData{}
+	for _, c := range g.points {
+		data.Indices = append(data.Indices, vertexs.add(objIndex{v: c.v, vt: -1, vn: -1}))
+	}
+	data.Vertexs = make([]SimpleVertex, len(vertexs.corners))
+	for i, c := range vertexs.corners {
+		data.Vertexs[i] = im.simpleVertex(c, mtl)
+	}
+	prim := &PointStringPrimitive{Type: PT_Point, Data: data}
+	prim.Material = name
+	return prim
+}
+
+func importObj(r io.Reader, dir string) (*Document, error) {
+	im := &objImporter{
+		doc:      newImportDocument(),
+		dir:      dir,
+		mtls:     make(map[string]*objMaterial),
+		current:  make(map[string]*objGroup),
+		textures: make(map[string]string),
+	}
+	if err := scanObj(r, im.statement); err != nil {
+		return nil, err
+	}
+
+	mesh := im.doc.Meshes[MESH_ROOT]
+	for _, g := range im.groups {
+		if len(g.triangles) > 0 {
+			mesh.Primitives = append(mesh.Primitives, im.meshPrimitive(g))
+		}
+		if len(g.lines) > 0 {
+			mesh.Primitives = append(mesh.Primitives, im.polylinePrimitive(g))
+		}
+		if len(g.points) > 0 {
+			mesh.Primitives = append(mesh.Primitives, im.pointStringPrimitive(g))
+		}
+	}
+	return im.doc, nil
+}
+
+// ImportObj reads a Wavefront OBJ file into a document with a mesh
+// primitive per group and material, polygons being triangulated. Lines and
+// points become polyline and point string primitives. Positions are taken
+// as they are, without any change of up axis. Material libraries are only
+// loaded by OpenObj.
+func ImportObj(r io.Reader) (*Document, error) {
+	return importObj(r, "")
+}
+
+// OpenObj reads an OBJ file along with the MTL files and texture images it
+// refers to. MTL diffuse, specular and transparency values become render
+// materials; illum 0 makes a material unlit.
+func OpenObj(name string) (*Document, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return importObj(f, filepath.Dir(name))
+}
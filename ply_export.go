@@ -0,0 +1,139 @@
+package imdl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// PlyNoFeature is the feature_id of vertices that belong to no feature.
+const PlyNoFeature = -1
+
+type plyVertex struct {
+	Pos       [3]float32
+	Color     [4]uint8
+	FeatureId int32
+}
+
+type plyExporter struct {
+	vertexs []plyVertex
+	faces   [][3]uint32
+	edges   [][2]uint32
+}
+
+// simpleVertexs appends the vertices of a primitive and returns the index of
+// the first one.
+func (e *plyExporter) simpleVertexs(table *VertexTable, vertexs []*SimpleVertex) uint32 {
+	offset := uint32(len(e.vertexs))
+	for _, v := range vertexs {
+		c := table.vertexColor(v)
+		pv := plyVertex{Pos: v.Pos, Color: [4]uint8{c.R, c.G, c.B, c.A}, FeatureId: PlyNoFeature}
+		if id, ok := table.vertexFeatureId(v); ok {
+			pv.FeatureId = int32(id)
+		}
+		e.vertexs = append(e.vertexs, pv)
+	}
+	return offset
+}
+
+func (e *plyExporter) primitive(item PrimitiveItem) {
+	switch p := item.(type) {
+	case *MeshPrimitive:
+		if p.Data == nil {
+			return
+		}
+		d, table := worldMeshData(p)
+		offset := e.simpleVertexs(table, d.simpleVertexs())
+		for i := 0; i+2 < len(d.Indices); i += 3 {
+			e.faces = append(e.faces, [3]uint32{d.Indices[i] + offset, d.Indices[i+1] + offset, d.Indices[i+2] + offset})
+		}
+	case *PolylinePrimitive:
+		if p.Data == nil {
+			return
+		}
+		d, table := worldPolylineData(p)
+		offset := e.simpleVertexs(table, d.simpleVertexs())
+		for _, line := range d.LineStrings() {
+			for i := 0; i+1 < len(line); i++ {
+				e.edges = append(e.edges, [2]uint32{line[i] + offset, line[i+1] + offset})
+			}
+		}
+	case *PointStringPrimitive:
+		if p.Data == nil {
+			return
+		}
+		d, table := worldPointStringData(p)
+		vertexs := make([]*SimpleVertex, 0, len(d.Indices))
+		for _, i := range d.Indices {
+			if int(i) < len(d.Vertexs) {
+				vertexs = append(vertexs, &d.Vertexs[i])
+			}
+		}
+		e.simpleVertexs(table, vertexs)
+	}
+}
+
+func (e *plyExporter) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "ply")
+	fmt.Fprintln(bw, "format binary_little_endian 1.0")
+	fmt.Fprintln(bw, "comment flywave/go-imdl")
+	fmt.Fprintf(bw, "element vertex %d\n", len(e.vertexs))
+	fmt.Fprintln(bw, "property float x")
+	fmt.Fprintln(bw, "property float y")
+	fmt.Fprintln(bw, "property float z")
+	fmt.Fprintln(bw, "property uchar red")
+	fmt.Fprintln(bw, "property uchar green")
+	fmt.Fprintln(bw, "property uchar blue")
+	fmt.Fprintln(bw, "property uchar alpha")
+	fmt.Fprintln(bw, "property int feature_id")
+	fmt.Fprintf(bw, "element face %d\n", len(e.faces))
+	fmt.Fprintln(bw, "property list uchar uint vertex_indices")
+	fmt.Fprintf(bw, "element edge %d\n", len(e.edges))
+	fmt.Fprintln(bw, "property uint vertex1")
+	fmt.Fprintln(bw, "property uint vertex2")
+	fmt.Fprintln(bw, "end_header")
+
+	if err := binary.Write(bw, binary.LittleEndian, e.vertexs); err != nil {
+		return err
+	}
+	for _, f := range e.faces {
+		bw.WriteByte(3)
+		if err := binary.Write(bw, binary.LittleEndian, f); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(bw, binary.LittleEndian, e.edges); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ExportPly writes the primitives of a document as a binary little-endian
+// PLY file, with instances expanded. Mesh triangles become faces, polyline
+// segments edges, and point strings bare vertices. Every vertex carries its
+// decoded color and, in the custom feature_id property, its feature index or
+// PlyNoFeature.
+func ExportPly(doc *Document, w io.Writer) error {
+	e := &plyExporter{}
+	for _, k := range sortedKeys(doc.Meshes) {
+		for _, item := range doc.Meshes[k].Primitives {
+			e.primitive(item)
+		}
+	}
+	return e.write(w)
+}
+
+func SavePly(doc *Document, name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := ExportPly(doc, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
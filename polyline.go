@@ -0,0 +1,271 @@
+package imdl
+
+type PolylineParam uint8
+
+const (
+	PP_None             PolylineParam = 0
+	PP_Square           PolylineParam = 1 * 3
+	PP_Miter            PolylineParam = 2 * 3
+	PP_MiterInsideOnly  PolylineParam = 3 * 3
+	PP_JointBase        PolylineParam = 4 * 3
+	PP_NegatePerp       PolylineParam = 8 * 3
+	PP_NegateAlong      PolylineParam = 16 * 3
+	PP_NoneAdjustWeight PolylineParam = 32 * 3
+)
+
+func (p PolylineParam) IsJoint() bool {
+	return p >= PP_JointBase && p < PP_NegatePerp
+}
+
+func DecodeNextIndicesAndParams(data []byte) ([]uint32, []PolylineParam) {
+	count := len(data) / 4
+	nextIndices := make([]uint32, count)
+	params := make([]PolylineParam, count)
+	for i := 0; i < count; i++ {
+		nextIndices[i] = decodeIndexAt(data, i*4)
+		params[i] = PolylineParam(data[i*4+3])
+	}
+	return nextIndices, params
+}
+
+func EncodeNextIndicesAndParams(nextIndices []uint32, params []PolylineParam) []byte {
+	data := make([]byte, len(nextIndices)*4)
+	for i := range nextIndices {
+		encodeIndex(nextIndices[i], data, i*4)
+		if i < len(params) {
+			data[i*4+3] = byte(params[i])
+		}
+	}
+	return data
+}
+
+/**
+ *  Each segment of a tesselated polyline is drawn as a quad of 6 vertices,
+ *  optionally followed by 3 joint triangles (9 vertices) at either end.
+ */
+type TesselatedPolyline struct {
+	Indices     []uint32
+	PrevIndices []uint32
+	NextIndices []uint32
+	Params      []PolylineParam
+}
+
+func (p *TesselatedPolyline) Decode(indices []byte, prevIndices []byte, nextIndicesAndParams []byte) {
+	p.Indices = DecodeVertexIndices(indices)
+	p.PrevIndices = DecodeVertexIndices(prevIndices)
+	p.NextIndices, p.Params = DecodeNextIndicesAndParams(nextIndicesAndParams)
+}
+
+func (p *TesselatedPolyline) EncodeIndices() []byte {
+	return EncodeVertexIndices(p.Indices)
+}
+
+func (p *TesselatedPolyline) EncodePrevIndices() []byte {
+	return EncodeVertexIndices(p.PrevIndices)
+}
+
+func (p *TesselatedPolyline) EncodeNextIndicesAndParams() []byte {
+	return EncodeNextIndicesAndParams(p.NextIndices, p.Params)
+}
+
+func (p *TesselatedPolyline) IsValid() bool {
+	n := len(p.Indices)
+	return n > 0 && len(p.PrevIndices) == n && len(p.NextIndices) == n && len(p.Params) == n
+}
+
+func (p *TesselatedPolyline) Lines() [][]uint32 {
+	if !p.IsValid() {
+		return nil
+	}
+
+	var lines [][]uint32
+	var line []uint32
+
+	for i := 0; i+2 < len(p.Indices); {
+		if p.Params[i+1].IsJoint() {
+			i += 3
+			continue
+		}
+
+		idx0, idx1, prev := p.Indices[i], p.Indices[i+1], p.PrevIndices[i]
+		n := len(line)
+		if n >= 2 && line[n-1] == idx0 && line[n-2] == prev {
+			line = append(line, idx1)
+		} else {
+			if line != nil {
+				lines = append(lines, line)
+			}
+			line = []uint32{idx0, idx1}
+		}
+		i += 6
+	}
+
+	if line != nil {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+type polylineVertex struct {
+	isSegmentStart       bool
+	isPolylineStartOrEnd bool
+	vertexIndex          uint32
+	prevIndex            uint32
+	nextIndex            uint32
+}
+
+func (v *polylineVertex) init(isSegmentStart bool, isPolylineStartOrEnd bool, vertexIndex uint32, prevIndex uint32, nextIndex uint32) {
+	v.isSegmentStart = isSegmentStart
+	v.isPolylineStartOrEnd = isPolylineStartOrEnd
+	v.vertexIndex = vertexIndex
+	v.prevIndex = prevIndex
+	v.nextIndex = nextIndex
+}
+
+func (v *polylineVertex) computeParam(negatePerp bool, adjacentToJoint bool, joint bool, noDisplacement bool) PolylineParam {
+	if joint {
+		return PP_JointBase
+	}
+
+	var param PolylineParam
+	switch {
+	case noDisplacement:
+		param = PP_NoneAdjustWeight
+	case v.isPolylineStartOrEnd:
+		param = PP_Square
+	case adjacentToJoint:
+		param = PP_MiterInsideOnly
+	default:
+		param = PP_Miter
+	}
+
+	if negatePerp {
+		param += PP_NegatePerp
+	}
+	if !v.isSegmentStart {
+		param += PP_NegateAlong
+	}
+	return param
+}
+
+// Joints are expensive to draw, so in 3d they are only generated for lines
+// wide enough for them to be noticed.
+const jointWidthThreshold = 3
+
+func wantJointTriangles(weight uint32, is2d bool) bool {
+	return is2d || weight >= jointWidthThreshold
+}
+
+type polylineTesselator struct {
+	lines  [][]uint32
+	points [][3]float32
+	result TesselatedPolyline
+}
+
+func newPolylineTesselator(lines [][]uint32, points [][3]float32) *polylineTesselator {
+	return &polylineTesselator{lines: lines, points: points}
+}
+
+func (t *polylineTesselator) addVertex(v *polylineVertex, param PolylineParam) {
+	t.result.Indices = append(t.result.Indices, v.vertexIndex)
+	t.result.PrevIndices = append(t.result.PrevIndices, v.prevIndex)
+	t.result.NextIndices = append(t.result.NextIndices, v.nextIndex)
+	t.result.Params = append(t.result.Params, param)
+}
+
+func (t *polylineTesselator) addJointTriangles(v *polylineVertex) {
+	p0 := v.computeParam(false, true, false, true)
+	param := v.computeParam(false, false, true, false)
+	for i := PolylineParam(0); i < 3; i++ {
+		t.addVertex(v, p0)
+		t.addVertex(v, param+i+1)
+		t.addVertex(v, param+i)
+	}
+}
+
+func (t *polylineTesselator) dotProduct(v *polylineVertex) float64 {
+	pos := toVec3(t.points[v.vertexIndex])
+	prevDir := toVec3(t.points[v.prevIndex]).sub(pos)
+	nextDir := toVec3(t.points[v.nextIndex]).sub(pos)
+	prevLen, nextLen := prevDir.length(), nextDir.length()
+	if prevLen == 0 || nextLen == 0 {
+		return -1
+	}
+	return prevDir.dot(nextDir) / (prevLen * nextLen)
+}
+
+func (t *polylineTesselator) wantJoint(v *polylineVertex) bool {
+	const maxJointDot = -0.7
+	if t.points == nil || int(v.vertexIndex) >= len(t.points) || int(v.prevIndex) >= len(t.points) || int(v.nextIndex) >= len(t.points) {
+		return false
+	}
+	return t.dotProduct(v) > maxJointDot
+}
+
+func (t *polylineTesselator) tesselate() *TesselatedPolyline {
+	var v0, v1 polylineVertex
+
+	for _, line := range t.lines {
+		if len(line) < 2 {
+			continue
+		}
+
+		last := len(line) - 1
+		isClosed := line[0] == line[last]
+
+		for i := 0; i < last; i++ {
+			idx0 := line[i]
+			idx1 := line[i+1]
+			isStart := i == 0
+			isEnd := i == last-1
+
+			prevIdx0 := idx0
+			if !isStart {
+				prevIdx0 = line[i-1]
+			} else if isClosed {
+				prevIdx0 = line[last-1]
+			}
+
+			nextIdx1 := idx1
+			if !isEnd {
+				nextIdx1 = line[i+2]
+			} else if isClosed {
+				nextIdx1 = line[1]
+			}
+
+			v0.init(true, isStart && !isClosed, idx0, prevIdx0, idx1)
+			v1.init(false, isEnd && !isClosed, idx1, nextIdx1, idx0)
+
+			jointAt0 := (isClosed || !isStart) && t.wantJoint(&v0)
+			jointAt1 := (isClosed || !isEnd) && t.wantJoint(&v1)
+
+			t.addVertex(&v0, v0.computeParam(true, jointAt0, false, false))
+			t.addVertex(&v1, v1.computeParam(false, jointAt1, false, false))
+			t.addVertex(&v0, v0.computeParam(false, jointAt0, false, false))
+			t.addVertex(&v0, v0.computeParam(false, jointAt0, false, false))
+			t.addVertex(&v1, v1.computeParam(false, jointAt1, false, false))
+			t.addVertex(&v1, v1.computeParam(true, jointAt1, false, false))
+
+			if jointAt0 {
+				t.addJointTriangles(&v0)
+			}
+			if jointAt1 {
+				t.addJointTriangles(&v1)
+			}
+		}
+	}
+
+	return &t.result
+}
+
+// TesselatePolylines converts line strings into segment quads without joint
+// triangles. A line string whose first and last index match is closed.
+func TesselatePolylines(lines [][]uint32) *TesselatedPolyline {
+	return newPolylineTesselator(lines, nil).tesselate()
+}
+
+// TesselatePolylinesWithJoints also adds joint triangles wherever two
+// segments of a line string meet at a visible angle.
+func TesselatePolylinesWithJoints(lines [][]uint32, points [][3]float32) *TesselatedPolyline {
+	return newPolylineTesselator(lines, points).tesselate()
+}
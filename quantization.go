@@ -13,7 +13,7 @@ func computeScale(extent float32, rangeScale uint16) float32 {
 }
 
 func isInRange(qpos uint16, rangeScale uint16) bool {
-	return qpos >= 0 && qpos < rangeScale+1
+	return qpos >= 0 && uint32(qpos) < uint32(rangeScale)+1
 }
 
 func Quantize(pos float32, origin float32, scale float32, rangeScale uint16) uint16 {
@@ -67,8 +67,7 @@ func (p *QParams2d) rangeDiagonal() [2]float32 {
 }
 
 func (p *QParams2d) GetRange() *Range2d {
-	r := &Range2d{}
-	r.Extend(p.Origin)
+	r := &Range2d{Low: p.Origin, High: p.Origin}
 	d := p.rangeDiagonal()
 	r.ExtendXY(p.Origin[0]+d[0], p.Origin[1]+d[1])
 	return r
@@ -130,8 +129,7 @@ func (p *QParams3d) rangeDiagonal() [3]float32 {
 }
 
 func (p *QParams3d) GetRange() *Range3d {
-	r := &Range3d{}
-	r.Extend(p.Origin)
+	r := &Range3d{Low: p.Origin, High: p.Origin}
 	d := p.rangeDiagonal()
 	r.ExtendXYZ(p.Origin[0]+d[0], p.Origin[1]+d[1], p.Origin[2]+d[2])
 	return r
@@ -17,3 +17,18 @@ func TestQuantize(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestQParamsGetRange(t *testing.T) {
+	range_ := CreateRange3d([][3]float32{{-10, -20, -30}, {-5, -2, -3}})
+	if range_.Low != [3]float32{-10, -20, -30} || range_.High != [3]float32{-5, -2, -3} {
+		t.FailNow()
+	}
+
+	qparams := &QParams3d{}
+	qparams.SetFromRange(range_, rangeScale16)
+
+	r := qparams.GetRange()
+	if r.Low != range_.Low || r.High[0] > -4.99 || r.High[0] < -5.01 || r.High[2] > -2.99 {
+		t.FailNow()
+	}
+}
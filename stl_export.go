@@ -0,0 +1,111 @@
+package imdl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+type StlOptions struct {
+	// FeatureIds keeps only the triangles of these features. A triangle
+	// belongs to the feature of its first vertex. All triangles are kept when
+	// it is empty.
+	FeatureIds []uint32
+	// Materials keeps only the primitives that use one of these materials.
+	// All primitives are kept when it is empty.
+	Materials []string
+}
+
+type stlTriangle struct {
+	Normal    [3]float32
+	Vertexs   [3][3]float32
+	Attribute uint16
+}
+
+func (opts *StlOptions) filter() (map[uint32]bool, map[string]bool) {
+	var features map[uint32]bool
+	if len(opts.FeatureIds) > 0 {
+		features = make(map[uint32]bool, len(opts.FeatureIds))
+		for _, id := range opts.FeatureIds {
+			features[id] = true
+		}
+	}
+	var materials map[string]bool
+	if len(opts.Materials) > 0 {
+		materials = make(map[string]bool, len(opts.Materials))
+		for _, m := range opts.Materials {
+			materials[m] = true
+		}
+	}
+	return features, materials
+}
+
+// stlTriangles returns the triangles of a mesh in world coordinates, with
+// instances expanded, that belong to one of features when it is set.
+func stlTriangles(p *MeshPrimitive, features map[uint32]bool) []stlTriangle {
+	d, table := worldMeshData(p)
+	var triangles []stlTriangle
+	for i := 0; i+2 < len(d.Indices); i += 3 {
+		i0, i1, i2 := d.Indices[i], d.Indices[i+1], d.Indices[i+2]
+		if int(i0) >= len(d.Vertexs) || int(i1) >= len(d.Vertexs) || int(i2) >= len(d.Vertexs) {
+			continue
+		}
+		if features != nil {
+			id, ok := table.vertexFeatureId(&d.Vertexs[i0].SimpleVertex)
+			if !ok || !features[id] {
+				continue
+			}
+		}
+		t := stlTriangle{Vertexs: [3][3]float32{d.Vertexs[i0].Pos, d.Vertexs[i1].Pos, d.Vertexs[i2].Pos}}
+		a, b, c := toVec3(t.Vertexs[0]), toVec3(t.Vertexs[1]), toVec3(t.Vertexs[2])
+		n := b.sub(a).cross(c.sub(a))
+		if l := n.length(); l > 0 {
+			n = n.scale(1 / l)
+		}
+		t.Normal = [3]float32{float32(n[0]), float32(n[1]), float32(n[2])}
+		triangles = append(triangles, t)
+	}
+	return triangles
+}
+
+// ExportStl writes the mesh primitives of a document as a binary STL file,
+// each triangle in world coordinates with its facet normal. Polylines and
+// point strings have no STL equivalent and are skipped.
+func ExportStl(doc *Document, w io.Writer, opts StlOptions) error {
+	features, materials := opts.filter()
+	var triangles []stlTriangle
+	for _, k := range sortedKeys(doc.Meshes) {
+		for _, item := range doc.Meshes[k].Primitives {
+			p, ok := item.(*MeshPrimitive)
+			if !ok || p.Data == nil || (materials != nil && !materials[p.Material]) {
+				continue
+			}
+			triangles = append(triangles, stlTriangles(p, features)...)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	var header [80]byte
+	copy(header[:], "flywave/go-imdl")
+	bw.Write(header[:])
+	if err := binary.Write(bw, binary.LittleEndian, uint32(len(triangles))); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, triangles); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func SaveStl(doc *Document, name string, opts StlOptions) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := ExportStl(doc, f, opts); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -2,6 +2,7 @@ package imdl
 
 import (
 	"bytes"
+	"fmt"
 	"image"
 	"image/jpeg"
 	"image/png"
@@ -20,12 +21,13 @@ const (
 	FormatPNG TextureFormat = 2
 )
 
-func encodeImage(format TextureFormat, writer io.Writer, rgba image.Image) {
+func encodeImage(format TextureFormat, writer io.Writer, rgba image.Image) error {
 	if format == FormatJPG {
-		jpeg.Encode(writer, rgba, nil)
+		return jpeg.Encode(writer, rgba, nil)
 	} else if format == FormatPNG {
-		png.Encode(writer, rgba)
+		return png.Encode(writer, rgba)
 	}
+	return fmt.Errorf("imdl: Unsupported texture format %d", format)
 }
 
 func decodeImage(format TextureFormat, reader io.Reader) image.Image {
@@ -45,12 +47,29 @@ func decodeImage(format TextureFormat, reader io.Reader) image.Image {
 	return nil
 }
 
-func EncodeTexture(texture image.Image, format TextureFormat) []byte {
+func EncodeTexture(texture image.Image, format TextureFormat) ([]byte, error) {
 	writer := &bytes.Buffer{}
-	encodeImage(format, writer, texture)
-	return writer.Bytes()
+	if err := encodeImage(format, writer, texture); err != nil {
+		return nil, err
+	}
+	return writer.Bytes(), nil
 }
 
 func DecodeTexture(data []byte, format TextureFormat) image.Image {
 	return decodeImage(format, bytes.NewBuffer(data))
 }
+
+// textureImage returns the encoded image of a named texture, or nil when the
+// document has no data for it.
+func (doc *Document) textureImage(name string) ([]byte, TextureFormat, error) {
+	t, ok := doc.NamedTextures[name]
+	if !ok {
+		return nil, 0, nil
+	}
+	format := TextureFormat(t.Format)
+	if t.TextureData != nil {
+		data, err := EncodeTexture(t.TextureData, format)
+		return data, format, err
+	}
+	return doc.FindBuffer(t.BufferView), format, nil
+}
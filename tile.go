@@ -0,0 +1,261 @@
+package imdl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ImdlVersion is written for tiles that do not carry a version of their own.
+const ImdlVersion uint32 = 0x001b0000
+
+type ImdlFlags uint32
+
+const (
+	IF_None                  ImdlFlags = 0
+	IF_ContainsCurves        ImdlFlags = 1 << 0
+	IF_Incomplete            ImdlFlags = 1 << 2
+	IF_DisallowMagnification ImdlFlags = 1 << 3
+)
+
+type GeometryClass uint8
+
+const (
+	GC_Primary      GeometryClass = 0
+	GC_Construction GeometryClass = 1
+	GC_Dimension    GeometryClass = 2
+	GC_Pattern      GeometryClass = 3
+)
+
+type Feature struct {
+	ElementId     uint64
+	SubCategoryId uint64
+	GeometryClass GeometryClass
+}
+
+type FeatureTable struct {
+	MaxFeatures uint32
+	Features    []Feature
+}
+
+func DecodeFeatureTable(data []byte) (*FeatureTable, error) {
+	var header featureTableHeader
+	headerSize := binary.Size(header)
+	if len(data) < headerSize {
+		return nil, errors.New("imdl: Invalid feature table header")
+	}
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &header)
+	if int(header.Length) > len(data) || header.Length%4 != 0 || headerSize+int(header.Count)*12 > int(header.Length) {
+		return nil, errors.New("imdl: Invalid feature table length")
+	}
+
+	subCatOffset := headerSize + int(header.Count)*12
+	subCats := make([]uint64, (int(header.Length)-subCatOffset)/8)
+	for i := range subCats {
+		subCats[i] = binary.LittleEndian.Uint64(data[subCatOffset+i*8:])
+	}
+
+	table := &FeatureTable{MaxFeatures: header.MaxFeatures, Features: make([]Feature, header.Count)}
+	for i := range table.Features {
+		offset := headerSize + i*12
+		packed := binary.LittleEndian.Uint32(data[offset+8:])
+		subCatIndex := int(packed & 0xffffff)
+		if subCatIndex >= len(subCats) {
+			return nil, errors.New("imdl: Invalid feature subcategory index")
+		}
+		table.Features[i] = Feature{
+			ElementId:     binary.LittleEndian.Uint64(data[offset:]),
+			SubCategoryId: subCats[subCatIndex],
+			GeometryClass: GeometryClass(packed >> 24),
+		}
+	}
+	return table, nil
+}
+
+func EncodeFeatureTable(table *FeatureTable) []byte {
+	var subCats []uint64
+	subCatIndices := make(map[uint64]uint32)
+	packed := make([]uint32, len(table.Features))
+	for i, f := range table.Features {
+		index, ok := subCatIndices[f.SubCategoryId]
+		if !ok {
+			index = uint32(len(subCats))
+			subCatIndices[f.SubCategoryId] = index
+			subCats = append(subCats, f.SubCategoryId)
+		}
+		packed[i] = (index & 0xffffff) | uint32(f.GeometryClass)<<24
+	}
+
+	maxFeatures := table.MaxFeatures
+	if maxFeatures < uint32(len(table.Features)) {
+		maxFeatures = uint32(len(table.Features))
+	}
+
+	headerSize := binary.Size(featureTableHeader{})
+	length := headerSize + len(table.Features)*12 + len(subCats)*8
+	data := make([]byte, length)
+	binary.LittleEndian.PutUint32(data[0:], uint32(length))
+	binary.LittleEndian.PutUint32(data[4:], maxFeatures)
+	binary.LittleEndian.PutUint32(data[8:], uint32(len(table.Features)))
+
+	offset := headerSize
+	for i, f := range table.Features {
+		binary.LittleEndian.PutUint64(data[offset:], f.ElementId)
+		binary.LittleEndian.PutUint32(data[offset+8:], packed[i])
+		offset += 12
+	}
+	for _, id := range subCats {
+		binary.LittleEndian.PutUint64(data[offset:], id)
+		offset += 8
+	}
+	return data
+}
+
+type Tile struct {
+	Version             uint32
+	Flags               ImdlFlags
+	ContentRange        [2][3]float64
+	Tolerance           float64
+	NumElementsIncluded uint32
+	NumElementsExcluded uint32
+	// EmptySubRanges is only stored from major version 2 on.
+	EmptySubRanges uint32
+	FeatureTable   FeatureTable
+	Document       *Document
+}
+
+func (t *Tile) VersionMajor() uint16 {
+	return uint16(t.Version >> 16)
+}
+
+func (t *Tile) VersionMinor() uint16 {
+	return uint16(t.Version & 0xffff)
+}
+
+func (t *Tile) HasFlag(flag ImdlFlags) bool {
+	return t.Flags&flag == flag
+}
+
+func OpenTile(name string) (*Tile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := NewDecoder(f)
+	tile := new(Tile)
+	if err = dec.DecodeTile(tile); err != nil {
+		tile = nil
+	}
+	return tile, err
+}
+
+func SaveTile(tile *Tile, name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := NewEncoder(f).EncodeTile(tile); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (d *Decoder) DecodeTile(tile *Tile) error {
+	var header imdlHeader
+	headerSize := binary.Size(header)
+	if err := binary.Read(d.r, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if header.Magic != imdlHeaderMagic || int(header.HeaderLength) < headerSize {
+		return errors.New("imdl: Invalid imdl tile header")
+	}
+
+	tile.Version = header.Version
+	tile.Flags = ImdlFlags(header.Flags)
+	tile.ContentRange = header.ContentRange
+	tile.Tolerance = header.Tolerance
+	tile.NumElementsIncluded = header.NumElementsIncluded
+	tile.NumElementsExcluded = header.NumElementsExcluded
+	tile.EmptySubRanges = 0
+	if tile.VersionMajor() >= 2 && int(header.HeaderLength) >= headerSize+4 {
+		if err := binary.Read(d.r, binary.LittleEndian, &tile.EmptySubRanges); err != nil {
+			return err
+		}
+		headerSize += 4
+	}
+	if _, err := d.r.Discard(int(header.HeaderLength) - headerSize); err != nil {
+		return err
+	}
+
+	var ftHeader featureTableHeader
+	chunk, err := d.r.Peek(binary.Size(ftHeader))
+	if err != nil {
+		return err
+	}
+	binary.Read(bytes.NewReader(chunk), binary.LittleEndian, &ftHeader)
+	ftData := make([]byte, ftHeader.Length)
+	if _, err := io.ReadFull(d.r, ftData); err != nil {
+		return err
+	}
+	table, err := DecodeFeatureTable(ftData)
+	if err != nil {
+		return err
+	}
+	tile.FeatureTable = *table
+
+	tile.Document = new(Document)
+	return d.Decode(tile.Document)
+}
+
+func (e *Encoder) EncodeTile(tile *Tile) error {
+	if tile.Document == nil {
+		return errors.New("imdl: Tile has no document")
+	}
+
+	e.prepare(tile.Document, true)
+	glb, err := e.layoutBinary(tile.Document)
+	if err != nil {
+		return err
+	}
+	featureTable := EncodeFeatureTable(&tile.FeatureTable)
+
+	version := tile.Version
+	if version == 0 {
+		version = ImdlVersion
+	}
+
+	headerSize := uint32(binary.Size(imdlHeader{}))
+	hasEmptySubRanges := version>>16 >= 2
+	if hasEmptySubRanges {
+		headerSize += 4
+	}
+	header := imdlHeader{
+		Magic:               imdlHeaderMagic,
+		Version:             version,
+		HeaderLength:        headerSize,
+		Flags:               uint32(tile.Flags),
+		ContentRange:        tile.ContentRange,
+		Tolerance:           tile.Tolerance,
+		NumElementsIncluded: tile.NumElementsIncluded,
+		NumElementsExcluded: tile.NumElementsExcluded,
+		TileLength:          headerSize + uint32(len(featureTable)) + glb.header.Length,
+	}
+
+	if err := binary.Write(e.w, binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("imdl: writing tile header: %w", err)
+	}
+	if hasEmptySubRanges {
+		if err := binary.Write(e.w, binary.LittleEndian, tile.EmptySubRanges); err != nil {
+			return fmt.Errorf("imdl: writing tile header: %w", err)
+		}
+	}
+	if _, err := e.w.Write(featureTable); err != nil {
+		return fmt.Errorf("imdl: writing feature table: %w", err)
+	}
+	return e.writeBinary(tile.Document, glb)
+}
@@ -1,5 +1,20 @@
 package imdl
 
+import (
+	"reflect"
+	"sort"
+)
+
+func sortedKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	names := make([]string, len(keys))
+	for i := range keys {
+		names[i] = keys[i].String()
+	}
+	sort.Strings(names)
+	return names
+}
+
 func calcPadding(offset, paddingUnit uint32) uint32 {
 	padding := offset % paddingUnit
 	if padding != 0 {
@@ -7,14 +22,3 @@ func calcPadding(offset, paddingUnit uint32) uint32 {
 	}
 	return padding
 }
-
-func createPaddingBytes(bytes []byte, offset, paddingUnit uint32, paddingCode byte) []byte {
-	padding := calcPadding(offset, paddingUnit)
-	if padding == 0 {
-		return bytes
-	}
-	for i := 0; i < int(padding); i++ {
-		bytes = append(bytes, paddingCode)
-	}
-	return bytes
-}
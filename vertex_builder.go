@@ -100,6 +100,24 @@ func (b *SimpleBuilder) AppendFeatureIndex(featureIndex *uint32) {
 	}
 }
 
+func (b *SimpleBuilder) AppendFeatureAndMaterialIndex(featureIndex *uint32, materialIndex *uint8) {
+	if materialIndex == nil {
+		b.AppendFeatureIndex(featureIndex)
+		return
+	}
+	index := uint32(0)
+	if featureIndex != nil {
+		index = *featureIndex & 0x00ffffff
+	}
+	b.Append32(index | uint32(*materialIndex)<<24)
+}
+
+func (b *SimpleBuilder) AppendMeshVertex(v *MeshVertex) {
+	b.AppendQuantizedPosition(v.QPos)
+	b.AppendColorIndex(v.ColorIndex)
+	b.AppendFeatureAndMaterialIndex(v.FeatureIndex, v.MaterialIndex)
+}
+
 type SimplePolylineBuilder struct {
 	SimpleBuilder
 }
@@ -131,7 +149,7 @@ func newSimpleMeshBuilder(vertexCount int) *SimpleMeshBuilder {
 }
 
 func (b *SimpleMeshBuilder) AppendVertex(v *MeshVertex) {
-	b.SimpleBuilder.AppendVertex(&v.SimpleVertex)
+	b.AppendMeshVertex(v)
 }
 
 func (b *SimpleMeshBuilder) Process(vertexs []MeshVertex) {
@@ -162,7 +180,7 @@ func (b *BaseMeshBuilder) AppendUV(uv *[2]uint16) {
 }
 
 func (b *BaseMeshBuilder) AppendVertex(v *MeshVertex) {
-	b.SimpleBuilder.AppendVertex(&v.SimpleVertex)
+	b.AppendMeshVertex(v)
 }
 
 func (b *BaseMeshBuilder) Process(vertexs []MeshVertex) {
@@ -238,8 +256,12 @@ func newLitMeshBuilder(vertexCount int) *LitMeshBuilder {
 }
 
 func (b *LitMeshBuilder) AppendVertex(v *MeshVertex) {
-	b.BaseMeshBuilder.SimpleBuilder.AppendVertex(&v.SimpleVertex)
-	b.Append16(*v.OctEncodedNormal)
+	b.AppendMeshVertex(v)
+	if v.OctEncodedNormal != nil {
+		b.Append16(*v.OctEncodedNormal)
+	} else {
+		b.Advance(2)
+	}
 	b.Advance(2)
 }
 
@@ -0,0 +1,452 @@
+package imdl
+
+import (
+	"image/color"
+	"math"
+)
+
+const unusedVertex = math.MaxUint32
+
+const (
+	vk_UV uint8 = 1 << iota
+	vk_Normal
+	vk_Color
+	vk_ColorIndex
+	vk_FeatureIndex
+	vk_MaterialIndex
+)
+
+// vertexKey holds everything the encoder writes for a vertex, so two
+// vertices with equal keys are indistinguishable once encoded.
+type vertexKey struct {
+	flags      uint8
+	pos        [3]uint16
+	uv         [2]uint16
+	normal     uint16
+	color      color.NRGBA
+	colorIndex uint16
+	feature    uint32
+	material   uint8
+	// unique is set to keep a vertex from being merged with any other.
+	unique int
+}
+
+func simpleVertexKey(v *SimpleVertex, qparams *QParams3d) vertexKey {
+	k := vertexKey{pos: QuantizePoint3d(v.Pos, qparams)}
+	if v.Color != nil {
+		k.flags |= vk_Color
+		k.color = *v.Color
+	}
+	if v.ColorIndex != nil {
+		k.flags |= vk_ColorIndex
+		k.colorIndex = *v.ColorIndex
+	}
+	if v.FeatureIndex != nil {
+		k.flags |= vk_FeatureIndex
+		k.feature = *v.FeatureIndex
+	}
+	return k
+}
+
+func markUsed(used []bool, indices []uint32) {
+	for _, i := range indices {
+		if int(i) < len(used) {
+			used[i] = true
+		}
+	}
+}
+
+// compactVertices returns the new index of every vertex, unusedVertex for
+// the dropped ones, and the old indices of the vertices that are kept. The
+// first of several vertices with the same key is the one kept. It returns
+// nil when there is nothing to remove.
+func compactVertices(keys []vertexKey, used []bool) ([]uint32, []int) {
+	remap := make([]uint32, len(keys))
+	keep := make([]int, 0, len(keys))
+	seen := make(map[vertexKey]uint32, len(keys))
+	for i := range keys {
+		if !used[i] {
+			remap[i] = unusedVertex
+			continue
+		}
+		if j, ok := seen[keys[i]]; ok {
+			remap[i] = j
+			continue
+		}
+		remap[i] = uint32(len(keep))
+		seen[keys[i]] = remap[i]
+		keep = append(keep, i)
+	}
+	if len(keep) == len(keys) {
+		return nil, nil
+	}
+	return remap, keep
+}
+
+func mapIndex(remap []uint32, i uint32) (uint32, bool) {
+	if int(i) >= len(remap) || remap[i] == unusedVertex {
+		return 0, false
+	}
+	return remap[i], true
+}
+
+// remapIndices maps point indices, dropping those of no kept vertex.
+func remapIndices(indices []uint32, remap []uint32) []uint32 {
+	if indices == nil {
+		return nil
+	}
+	out := make([]uint32, 0, len(indices))
+	for _, i := range indices {
+		if j, ok := mapIndex(remap, i); ok {
+			out = append(out, j)
+		}
+	}
+	return out
+}
+
+// remapTriangles maps triangle indices, dropping every triangle with an
+// index of no kept vertex.
+func remapTriangles(indices []uint32, remap []uint32) []uint32 {
+	if indices == nil {
+		return nil
+	}
+	out := make([]uint32, 0, len(indices))
+	for k := 0; k+2 < len(indices); k += 3 {
+		i0, ok0 := mapIndex(remap, indices[k])
+		i1, ok1 := mapIndex(remap, indices[k+1])
+		i2, ok2 := mapIndex(remap, indices[k+2])
+		if ok0 && ok1 && ok2 {
+			out = append(out, i0, i1, i2)
+		}
+	}
+	return out
+}
+
+// remapLineString maps a line string, splitting it where a vertex is not
+// kept so that no segment joins the wrong vertices.
+func remapLineString(line []uint32, remap []uint32) [][]uint32 {
+	var lines [][]uint32
+	var cur []uint32
+	for _, i := range line {
+		j, ok := mapIndex(remap, i)
+		if ok {
+			cur = append(cur, j)
+			continue
+		}
+		if len(cur) >= 2 {
+			lines = append(lines, cur)
+		}
+		cur = nil
+	}
+	if len(cur) >= 2 {
+		lines = append(lines, cur)
+	}
+	return lines
+}
+
+func remapLineStrings(lines [][]uint32, remap []uint32) [][]uint32 {
+	var out [][]uint32
+	for _, line := range lines {
+		out = append(out, remapLineString(line, remap)...)
+	}
+	return out
+}
+
+// remapTesselation maps the tesselated triangles of a polyline, dropping a
+// triangle from all of Indices, PrevIndices, NextIndices and Params when any
+// of its indices is of no kept vertex.
+func (d *PolylineData) remapTesselation(remap []uint32) {
+	n := len(d.Indices)
+	indices := make([]uint32, 0, n)
+	prevIndices := make([]uint32, 0, n)
+	nextIndices := make([]uint32, 0, n)
+	params := make([]PolylineParam, 0, n)
+	for k := 0; k+2 < n; k += 3 {
+		var tri, prev, next [3]uint32
+		ok := true
+		for j := 0; j < 3 && ok; j++ {
+			var ok0, ok1, ok2 bool
+			tri[j], ok0 = mapIndex(remap, d.Indices[k+j])
+			prev[j], ok1 = mapIndex(remap, d.PrevIndices[k+j])
+			next[j], ok2 = mapIndex(remap, d.NextIndices[k+j])
+			ok = ok0 && ok1 && ok2
+		}
+		if !ok {
+			continue
+		}
+		indices = append(indices, tri[:]...)
+		prevIndices = append(prevIndices, prev[:]...)
+		nextIndices = append(nextIndices, next[:]...)
+		params = append(params, d.Params[k:k+3]...)
+	}
+	d.Indices, d.PrevIndices, d.NextIndices, d.Params = indices, prevIndices, nextIndices, params
+}
+
+func (d *MeshData) Compact() []uint32 {
+	return d.compact(true, nil)
+}
+
+func (d *MeshData) compact(weld bool, edges *EdgeData) []uint32 {
+	if len(d.Vertexs) == 0 {
+		return nil
+	}
+
+	qparams := d.GetPosQParams3d()
+	uvParams := d.GetUvQParams2d()
+	keys := make([]vertexKey, len(d.Vertexs))
+	for i := range d.Vertexs {
+		v := &d.Vertexs[i]
+		k := simpleVertexKey(&v.SimpleVertex, qparams)
+		if v.UV != nil && uvParams != nil {
+			k.flags |= vk_UV
+			k.uv = QuantizePoint2d(*v.UV, uvParams)
+		}
+		if v.Normal != nil {
+			k.flags |= vk_Normal
+			k.normal = encodeXYZ(v.Normal[0], v.Normal[1], v.Normal[2])
+		} else if v.OctEncodedNormal != nil {
+			k.flags |= vk_Normal
+			k.normal = *v.OctEncodedNormal
+		}
+		if v.MaterialIndex != nil {
+			k.flags |= vk_MaterialIndex
+			k.material = *v.MaterialIndex
+		}
+		if !weld {
+			k.unique = i
+		}
+		keys[i] = k
+	}
+
+	used := make([]bool, len(d.Vertexs))
+	markUsed(used, d.Indices)
+	if edges != nil {
+		for _, s := range edges.Segments {
+			markUsed(used, s[:])
+		}
+		for _, s := range edges.Silhouettes {
+			markUsed(used, s.Indices[:])
+		}
+		for _, p := range edges.Polylines {
+			markUsed(used, p)
+		}
+	}
+
+	remap, keep := compactVertices(keys, used)
+	if remap == nil {
+		return nil
+	}
+
+	vertexs := make([]MeshVertex, len(keep))
+	for i, j := range keep {
+		vertexs[i] = d.Vertexs[j]
+	}
+	d.Vertexs = vertexs
+	d.Indices = remapTriangles(d.Indices, remap)
+	return remap
+}
+
+func (d *PolylineData) Compact() []uint32 {
+	if len(d.Vertexs) == 0 {
+		return nil
+	}
+
+	qparams := d.GetQParams3d()
+	keys := make([]vertexKey, len(d.Vertexs))
+	for i := range d.Vertexs {
+		keys[i] = simpleVertexKey(&d.Vertexs[i], qparams)
+	}
+
+	used := make([]bool, len(d.Vertexs))
+	markUsed(used, d.Indices)
+	markUsed(used, d.PrevIndices)
+	markUsed(used, d.NextIndices)
+	for _, line := range d.Lines {
+		markUsed(used, line)
+	}
+
+	remap, keep := compactVertices(keys, used)
+	if remap == nil {
+		return nil
+	}
+
+	vertexs := make([]SimpleVertex, len(keep))
+	for i, j := range keep {
+		vertexs[i] = d.Vertexs[j]
+	}
+	d.Vertexs = vertexs
+	switch {
+	case len(d.Lines) > 0:
+		d.Lines = remapLineStrings(d.Lines, remap)
+		d.Indices, d.PrevIndices, d.NextIndices, d.Params = nil, nil, nil, nil
+	case d.HasPolylineParams():
+		d.remapTesselation(remap)
+	default:
+		// Indices hold a single line string that is yet to be tesselated.
+		lines := remapLineString(d.Indices, remap)
+		d.Indices, d.PrevIndices, d.NextIndices, d.Params = nil, nil, nil, nil
+		if len(lines) == 1 {
+			d.Indices = lines[0]
+		} else {
+			d.Lines = lines
+		}
+	}
+	return remap
+}
+
+func (d *PointStringData) Compact() []uint32 {
+	if len(d.Vertexs) == 0 {
+		return nil
+	}
+
+	qparams := d.GetQParams3d()
+	keys := make([]vertexKey, len(d.Vertexs))
+	for i := range d.Vertexs {
+		keys[i] = simpleVertexKey(&d.Vertexs[i], qparams)
+	}
+
+	used := make([]bool, len(d.Vertexs))
+	markUsed(used, d.Indices)
+
+	remap, keep := compactVertices(keys, used)
+	if remap == nil {
+		return nil
+	}
+
+	vertexs := make([]SimpleVertex, len(keep))
+	for i, j := range keep {
+		vertexs[i] = d.Vertexs[j]
+	}
+	d.Vertexs = vertexs
+	d.Indices = remapIndices(d.Indices, remap)
+	return remap
+}
+
+// remap drops the segments and silhouettes that collapse to a point once
+// their end points are welded.
+func (d *EdgeData) remap(remap []uint32) {
+	segments := d.Segments[:0]
+	for _, s := range d.Segments {
+		i0, ok0 := mapIndex(remap, s[0])
+		i1, ok1 := mapIndex(remap, s[1])
+		if ok0 && ok1 && i0 != i1 {
+			segments = append(segments, [2]uint32{i0, i1})
+		}
+	}
+	d.Segments = segments
+
+	silhouettes := d.Silhouettes[:0]
+	for _, s := range d.Silhouettes {
+		i0, ok0 := mapIndex(remap, s.Indices[0])
+		i1, ok1 := mapIndex(remap, s.Indices[1])
+		if ok0 && ok1 && i0 != i1 {
+			s.Indices = [2]uint32{i0, i1}
+			silhouettes = append(silhouettes, s)
+		}
+	}
+	d.Silhouettes = silhouettes
+
+	d.Polylines = remapLineStrings(d.Polylines, remap)
+}
+
+func (c *AuxChannels) keepVertices(keep []int) {
+	for _, inputs := range c.Displacements {
+		for j := range inputs {
+			inputs[j].Values = keepVectors(inputs[j].Values, keep)
+		}
+	}
+	for _, inputs := range c.Normals {
+		for j := range inputs {
+			inputs[j].Values = keepVectors(inputs[j].Values, keep)
+		}
+	}
+	for _, inputs := range c.Params {
+		for j := range inputs {
+			values := make([]float32, 0, len(keep))
+			for _, i := range keep {
+				if i < len(inputs[j].Values) {
+					values = append(values, inputs[j].Values[i])
+				}
+			}
+			inputs[j].Values = values
+		}
+	}
+}
+
+func keepVectors(src [][3]float32, keep []int) [][3]float32 {
+	values := make([][3]float32, 0, len(keep))
+	for _, i := range keep {
+		if i < len(src) {
+			values = append(values, src[i])
+		}
+	}
+	return values
+}
+
+// keptVertices inverts a remap table into the old indices of the kept
+// vertices.
+func keptVertices(remap []uint32) []int {
+	var keep []int
+	for i, j := range remap {
+		if j != unusedVertex && int(j) == len(keep) {
+			keep = append(keep, i)
+		}
+	}
+	return keep
+}
+
+func compactPrimitive(item PrimitiveItem) int {
+	switch p := item.(type) {
+	case *MeshPrimitive:
+		if p.Data == nil {
+			return 0
+		}
+		count := len(p.Data.Vertexs)
+		// Vertices with different aux channel values can't be merged, so
+		// meshes with aux channels only have their unused vertices dropped.
+		hasAux := p.AuxChannels != nil && p.AuxChannels.Channels != nil
+		remap := p.Data.compact(!hasAux, p.EdgeData)
+		if remap == nil {
+			return 0
+		}
+		if p.EdgeData != nil {
+			p.EdgeData.remap(remap)
+		}
+		if hasAux {
+			p.AuxChannels.Channels.keepVertices(keptVertices(remap))
+		}
+		return count - len(p.Data.Vertexs)
+	case *PolylinePrimitive:
+		if p.Data == nil {
+			return 0
+		}
+		count := len(p.Data.Vertexs)
+		p.Data.Compact()
+		return count - len(p.Data.Vertexs)
+	case *PointStringPrimitive:
+		if p.Data == nil {
+			return 0
+		}
+		count := len(p.Data.Vertexs)
+		p.Data.Compact()
+		return count - len(p.Data.Vertexs)
+	}
+	return 0
+}
+
+// CompactVertices merges vertices that encode identically, drops vertices
+// that no index refers to and returns the number of vertices removed.
+func (doc *Document) CompactVertices() int {
+	count := 0
+	for _, k := range sortedKeys(doc.Meshes) {
+		for _, item := range doc.Meshes[k].Primitives {
+			count += compactPrimitive(item)
+		}
+	}
+	for _, k := range sortedKeys(doc.PatternSymbols) {
+		for _, item := range doc.PatternSymbols[k].Primitives {
+			count += compactPrimitive(item)
+		}
+	}
+	return count
+}